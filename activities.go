@@ -2,32 +2,129 @@ package activities
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4/pgxpool" //for sql
 	"github.com/matthewboyd/activities/profile"
 	"github.com/sony/gobreaker"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 )
 
+// Activities is a row of the activities table, whose schema is managed by
+// the migrate package.
 type Activities struct {
-	Name     string
-	Postcode string
+	ID           int64         `json:"id"`
+	Name         string        `json:"name"`
+	Postcode     string        `json:"postcode"`
+	Sunny        bool          `json:"sunny"`
+	Category     string        `json:"category,omitempty"`
+	Coordinates  *Coordinates  `json:"coordinates,omitempty"`
+	Rating       float64       `json:"rating"`
+	Tags         []string      `json:"tags,omitempty"`
+	OpeningHours *OpeningHours `json:"opening_hours,omitempty"`
+	// NeedsDaylight activities are only recommended between sunrise and
+	// sunset, with at least MinDaylightMinutes of daylight left, so not
+	// when the weather doesn't say when those are.
+	NeedsDaylight      bool `json:"needs_daylight,omitempty"`
+	MinDaylightMinutes int  `json:"min_daylight_minutes,omitempty"`
+}
+
+// Recommendation is the activity chosen for a request along with how it was
+// chosen. Fallback explains why a different kind of activity than the one
+// asked for was returned.
+type Recommendation struct {
+	Activity   Activities
+	Weather    string
+	WeatherAt  time.Time
+	Cached     bool
+	Discarded  []Discarded
+	Fallback   string
+	DistanceKm *float64
+	// Repeat is set when the session was recently recommended the activity,
+	// because nothing else was suitable.
+	Repeat bool
+	// ClosesAt is when the activity closes, if it has opening hours.
+	ClosesAt *time.Time
+	// Sunset is when the sun sets on the day, when the weather says.
+	Sunset *time.Time
+	// Conditions is the weather the activity was judged on.
+	Conditions *Weather
+	// Score and Ranked are set when alternatives were asked for: Ranked
+	// holds them best first, each with the Score that placed it.
+	Score  *Score
+	Ranked []Recommendation
+}
+
+func (r *Recommendation) setClosesAt(at time.Time) {
+	if open, closes := r.Activity.OpeningHours.OpenAt(at); open && !closes.IsZero() {
+		r.ClosesAt = &closes
+	}
+}
+
+// RecommendationRequest holds what the caller asked for. A zero At means
+// now; a nil Near means anywhere. Activities recently recommended to
+// Session are avoided. Include and Exclude filter candidates by tag.
+type RecommendationRequest struct {
 	Sunny    bool
+	At       time.Time
+	Near     *Coordinates
+	RadiusKm float64
+	Strategy string
+	Session  string
+	Include  []string
+	Exclude  []string
+	// Limit is how many ranked alternatives to return; zero means just one,
+	// picked by the strategy.
+	Limit int
 }
 
 type Handler struct {
-	Logger         log.Logger
-	Db             pgxpool.Pool
-	Redis          redis.Client
-	CircuitBreaker *gobreaker.CircuitBreaker
+	Logger log.Logger
+	Db     *pgxpool.Pool
+	// Redis backs the weather cache, quota, rate limiter and history when
+	// they aren't configured. Left unset, they're all turned off.
+	Redis           *redis.Client
+	CircuitBreaker  *gobreaker.CircuitBreaker
+	WeatherProvider WeatherProvider
+	Repository      ActivityRepository
+	Rules           *RuleSet
+	WeatherCache    *WeatherCache
+	Geocoder        Geocoder
+	// Strategy is used when a request doesn't name one of Strategies.
+	Strategy       SelectionStrategy
+	Strategies     map[string]SelectionStrategy
+	strategiesOnce sync.Once
+	// MaxWeatherLookups caps how many candidates per request may need the
+	// weather fetched from the provider. Zero means the default of 10.
+	MaxWeatherLookups int
+	// WeatherConcurrency is how many of those lookups run at once. Zero
+	// means the default of 4.
+	WeatherConcurrency int
+	// Quota rations calls to the weather provider. It defaults to the
+	// OpenWeatherMap free tier, counted in Redis.
+	Quota *WeatherQuota
+	// TimeZone is where opening hours are evaluated when the weather
+	// provider doesn't give an offset. Nil means Europe/London.
+	TimeZone *time.Location
+	// RateLimiter limits how often clients may call endpoints wrapped with
+	// RateLimit. It defaults to 60 requests a minute, counted in Redis.
+	RateLimiter *RateLimiter
+	// History remembers what each session was recommended, in Redis.
+	History *RecentHistory
+	flights flightGroup
+}
+
+// redisClient returns the Redis client, or nil when none was set.
+func (h *Handler) redisClient() redis.Cmdable {
+	// a nil *redis.Client would make a Cmdable that isn't nil
+	if h.Redis == nil {
+		return nil
+	}
+	return h.Redis
 }
 
 type Weather struct {
@@ -35,14 +132,9 @@ type Weather struct {
 		Lon float64 `json:"lon"`
 		Lat float64 `json:"lat"`
 	} `json:"coord"`
-	Weather []struct {
-		ID          int    `json:"id"`
-		Main        string `json:"main"`
-		Description string `json:"description"`
-		Icon        string `json:"icon"`
-	} `json:"weather"`
-	Base string `json:"base"`
-	Main struct {
+	Weather []WeatherCondition `json:"weather"`
+	Base    string             `json:"base"`
+	Main    struct {
 		Temp      float64 `json:"temp"`
 		FeelsLike float64 `json:"feels_like"`
 		TempMin   float64 `json:"temp_min"`
@@ -75,137 +167,329 @@ type Weather struct {
 	Cod      int    `json:"cod"`
 }
 
+type WeatherCondition struct {
+	ID          int    `json:"id"`
+	Main        string `json:"main"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
 func (h *Handler) SunnyEndpoint() func(writer http.ResponseWriter, request *http.Request) {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		defer profile.Duration(time.Now(), "SunnyEndpoint")
-		writer.WriteHeader(http.StatusOK)
-		_, err := writer.Write([]byte(h.getSunnyActivity(request.Context())))
+		req, err := h.parseRecommendationRequest(request, true)
 		if err != nil {
-			log.Fatalln("could not write the bytes")
+			writeError(writer, err)
+			return
 		}
+		recommendation, err := h.getSunnyActivity(request.Context(), req)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writeRecommendation(writer, request, recommendation)
 	}
 }
 
-func (h *Handler) getSunnyActivity(ctx context.Context) string {
-	var activityList []Activities
-	var a Activities
+func (h *Handler) getSunnyActivity(ctx context.Context, req RecommendationRequest) (Recommendation, error) {
+	activityList, err := h.repository().Candidates(ctx, req.candidateFilter())
+	if err != nil {
+		return Recommendation{}, err
+	}
+	recommendation, err := h.retrieveActivity(ctx, req, activityList)
+	if reason := weatherFallback(err); reason != "" {
+		// the weather API can't be used and nothing is cached, so suggest
+		// something that doesn't depend on the weather instead
+		fallback := req
+		fallback.Sunny = false
+		recommendation, err = h.getNotSunnyActivities(ctx, fallback)
+		recommendation.Fallback = reason
+	}
+	return recommendation, err
+}
 
-	rows, err := h.Db.Query(ctx, "SELECT * FROM activities where sunny = $1", true)
+// retrieveActivity recommends one of the candidates. For sunny requests the
+// weather at every distinct candidate postcode is looked up concurrently,
+// at most maxWeatherLookups of them from the provider rather than the
+// cache, and the selection strategy picks among the candidates that suit
+// it. Candidates the session was recently recommended are only picked when
+// there's nothing else. When req.Limit is set the suitable candidates are
+// ranked instead, and the best is returned with the rest as Ranked. The
+// candidates slice is left untouched.
+func (h *Handler) retrieveActivity(ctx context.Context, req RecommendationRequest, candidates []Activities) (Recommendation, error) {
+	if len(candidates) == 0 {
+		return Recommendation{}, ErrNoActivities
+	}
+	strategy, err := h.strategy(req.Strategy)
 	if err != nil {
-		log.Fatalln("an error occurred in the sunny query", err)
+		return Recommendation{}, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&a.Name, &a.Postcode, &a.Sunny)
-		if err != nil {
-			log.Fatalln("Error when scanning the db rows", err)
+
+	ev, err := h.evaluate(ctx, req, strategy, candidates)
+	if err != nil {
+		return Recommendation{Discarded: ev.discarded}, err
+	}
+
+	if req.Limit > 0 {
+		ranked := h.rank(req, ev)
+		recommendation := ranked[0]
+		recommendation.Ranked = ranked
+		shown := make([]Activities, len(ranked))
+		for i, r := range ranked {
+			shown[i] = r.Activity
 		}
-		activityList = append(activityList, a)
+		h.recommended(ctx, req, strategy, shown...)
+		return recommendation, nil
 	}
-	log.Println("activityList", activityList)
-	if err != nil {
-		log.Fatalln("An error occurred", err)
-	}
-	var discardedActivityList []Activities
-	choosenActivity, _ := h.retrieveActivity(ctx, activityList, discardedActivityList, true, 0)
-	return fmt.Sprintf("%s %s", choosenActivity.Name, choosenActivity.Postcode)
-}
-
-func (h *Handler) retrieveActivity(ctx context.Context, newActivityList []Activities, discardedActivityList []Activities, sunny bool, tries int) (Activities, error) {
-	if tries > 3 {
-		return Activities{}, errors.New("we're having difficulties finding a sunny activity, why not try an allWeather activity")
-	}
-	s1 := rand.NewSource(time.Now().UnixNano())
-	r1 := rand.New(s1)
-	randomNumber := r1.Intn(len(newActivityList))
-	choosenActivity := newActivityList[randomNumber]
-	if sunny {
-		//check cache
-		value, err := h.Redis.Get(ctx, choosenActivity.Postcode).Result()
-		if err == redis.Nil {
-			// we want to call the API
-			weather := choosenActivity.GetWeather()
-
-			_ = h.Redis.Set(ctx, choosenActivity.Postcode, weather, time.Minute*10).Err()
-
-			if weather != "Rain" && weather != "Snow" && weather != "Drizzle" {
-				return choosenActivity, nil
-			} else {
-				discardedActivityList = append(discardedActivityList, choosenActivity)
-				newActivityList = h.RemoveIndex(newActivityList, randomNumber)
-				tries++
-				return h.retrieveActivity(ctx, newActivityList, discardedActivityList, true, tries)
+
+	pool, repeats := splitRecent(ev.suitable, ev.recent)
+	if len(pool) == 0 {
+		pool = repeats
+	}
+	choosenActivity := pool[strategy.Pick(pool)]
+	recommendation := h.newRecommendation(req, ev, choosenActivity)
+	h.recommended(ctx, req, strategy, choosenActivity)
+	return recommendation, nil
+}
+
+// evaluation is what checking the candidates for a request found.
+type evaluation struct {
+	// suitable is in the order the strategy would try them, with those the
+	// session was recently recommended last.
+	suitable  []Activities
+	weather   map[string]weatherResult
+	recent    map[int64]bool
+	discarded []Discarded
+}
+
+// evaluate keeps the candidates that are open at the time asked for and,
+// for sunny requests, suit the weather and daylight then. Unless alternatives
+// are to be ranked, it stops at the first that suits, so candidates after it
+// are neither looked up nor reported. It fails when none suit.
+func (h *Handler) evaluate(ctx context.Context, req RecommendationRequest, strategy SelectionStrategy, candidates []Activities) (evaluation, error) {
+	var ev evaluation
+	candidates, closed := h.openCandidates(req, candidates)
+	if len(candidates) == 0 {
+		ev.discarded = closed
+		if next := soonestOpening(closed); next != nil {
+			return ev, fmt.Errorf("%w: all %d candidates are closed then, the first opens at %s", ErrNoActivities, len(closed), next.Format(time.RFC3339))
+		}
+		return ev, fmt.Errorf("%w: all %d candidates are closed then", ErrNoActivities, len(closed))
+	}
+
+	if req.Session != "" {
+		ev.recent = h.history().Recent(ctx, req.Session)
+	}
+	fresh, repeats := splitRecent(candidates, ev.recent)
+
+	if !req.Sunny {
+		ev.suitable = append(fresh, repeats...)
+		ev.discarded = closed
+		return ev, nil
+	}
+
+	// the strategy's order decides which postcodes are worth a lookup when
+	// there are more than the limit, with repeats last
+	ordered := append(strategyOrder(strategy, fresh), strategyOrder(strategy, repeats)...)
+	// one suitable candidate is enough without a limit, so the weather is
+	// looked up a batch at a time until the next in order suits
+	batch := h.maxWeatherLookups()
+	if req.Limit == 0 {
+		batch = h.weatherConcurrency()
+	}
+	ev.weather = make(map[string]weatherResult)
+	fetched := 0
+
+	var skipped []Activities
+	var discarded []Discarded
+	var weatherErr, fatalErr error
+	for i, a := range ordered {
+		if req.Limit == 0 && len(ev.suitable) > 0 {
+			break
+		}
+		result, ok := ev.weather[NormalizePostcode(a.Postcode)]
+		if !ok && fetched < h.maxWeatherLookups() {
+			limit := h.maxWeatherLookups() - fetched
+			if batch < limit {
+				limit = batch
+			}
+			fetched += h.lookUpWeather(ctx, ev.weather, ordered[i:], req.At, limit)
+			if err := ctx.Err(); err != nil {
+				return ev, err
+			}
+			result, ok = ev.weather[NormalizePostcode(a.Postcode)]
+		}
+		if !ok {
+			skipped = append(skipped, a)
+			continue
+		}
+		if result.err != nil {
+			// these apply to every candidate, so are returned as they are
+			if weatherFallback(result.err) != "" || errors.Is(result.err, ErrForecastOutOfRange) {
+				fatalErr = result.err
 			}
-		} else if err != nil {
-			return Activities{}, err
-		} else {
-			// build response
-			if value != "Rain" && value != "Snow" && value != "Drizzle" {
-				return choosenActivity, nil
-			} else {
-				discardedActivityList = append(discardedActivityList, choosenActivity)
-				newActivityList = h.RemoveIndex(newActivityList, randomNumber)
-				tries++
-				return h.retrieveActivity(ctx, newActivityList, discardedActivityList, true, tries)
+			weatherErr = result.err
+			discarded = append(discarded, Discarded{Activity: a, Reason: result.err.Error(), err: result.err})
+			continue
+		}
+		if ok, reason := h.rules().For(a).Evaluate(result.weather); !ok {
+			discarded = append(discarded, Discarded{Activity: a, Reason: reason})
+			continue
+		}
+		if ok, reason := h.checkDaylight(a, result.weather, req.targetTime()); !ok {
+			discarded = append(discarded, Discarded{Activity: a, Reason: reason})
+			continue
+		}
+		// the provider knows the local time better than the configured zone
+		if a.OpeningHours != nil {
+			at := req.targetTime().In(h.zoneFor(&result.weather))
+			if open, _ := a.OpeningHours.OpenAt(at); !open {
+				reason, next := a.OpeningHours.closedReason(at)
+				closed = append(closed, Discarded{Activity: a, Reason: reason, NextOpen: next})
+				continue
 			}
 		}
+		ev.suitable = append(ev.suitable, a)
+	}
+	ev.discarded = append(closed, discarded...)
 
-	} else {
-		return choosenActivity, nil
+	if len(ev.suitable) == 0 {
+		switch {
+		case fatalErr != nil:
+			return ev, fatalErr
+		case weatherErr != nil && allWeatherErrors(discarded):
+			return ev, weatherErr
+		case len(skipped) > 0:
+			return ev, fmt.Errorf("%w: gave up after %d weather lookups, why not try an allWeather activity", ErrNoActivities, h.maxWeatherLookups())
+		}
+		return ev, fmt.Errorf("%w: none of the %d candidates suit the weather, why not try an allWeather activity", ErrNoActivities, len(discarded))
 	}
+	return ev, nil
 }
 
-func (a *Activities) GetWeather() string {
+// lookUpWeather adds the weather for candidates to found, for postcodes it
+// doesn't have yet, fetching at most limit from the provider. It returns
+// how many weren't cached.
+func (h *Handler) lookUpWeather(ctx context.Context, found map[string]weatherResult, candidates []Activities, at time.Time, limit int) int {
+	var missing []Activities
+	for _, a := range candidates {
+		if _, ok := found[NormalizePostcode(a.Postcode)]; !ok {
+			missing = append(missing, a)
+		}
+	}
+	fetched := 0
+	for postcode, result := range h.prefetchWeather(ctx, missing, at, limit) {
+		found[postcode] = result
+		if !result.cached {
+			fetched++
+		}
+	}
+	return fetched
+}
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?appid=%s&q=%s", os.Getenv("WEATHER_API_KEY"), a.Postcode)
-	response, err := http.Get(url)
-	if err != nil {
-		log.Fatalln("retrieving the weather", err)
+// newRecommendation describes a, one of the suitable candidates in ev.
+func (h *Handler) newRecommendation(req RecommendationRequest, ev evaluation, a Activities) Recommendation {
+	recommendation := Recommendation{
+		Activity:   a,
+		Discarded:  ev.discarded,
+		DistanceKm: distanceFrom(req, a),
+		Repeat:     ev.recent[a.ID],
 	}
-	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Fatalln("retriving the body", err)
+	result, ok := ev.weather[NormalizePostcode(a.Postcode)]
+	if !ok {
+		recommendation.setClosesAt(req.targetTime().In(h.timeZone()))
+		return recommendation
+	}
+	recommendation.Weather = result.weather.Weather[0].Main
+	recommendation.Cached = result.cached
+	recommendation.Conditions = &result.weather
+	if result.weather.Dt != 0 {
+		recommendation.WeatherAt = time.Unix(int64(result.weather.Dt), 0).UTC()
+	}
+	recommendation.setClosesAt(req.targetTime().In(h.zoneFor(&result.weather)))
+	if _, sunset, ok := h.sunTimes(result.weather, req.targetTime()); ok {
+		recommendation.Sunset = &sunset
 	}
-	var weather Weather
+	return recommendation
+}
 
-	if err := json.Unmarshal(body, &weather); err != nil {
-		log.Fatalln("error unmarshalling response to json", err)
+// recommended tells the strategy and the session's history that the
+// activities, best first, were recommended. The strategy hears about the
+// best last, so it counts as the most recent.
+func (h *Handler) recommended(ctx context.Context, req RecommendationRequest, strategy SelectionStrategy, activityList ...Activities) {
+	for i := len(activityList) - 1; i >= 0; i-- {
+		strategy.Recommended(activityList[i])
+	}
+	if req.Session == "" {
+		return
+	}
+	if err := h.history().Add(ctx, req.Session, activityList...); err != nil {
+		log.Println("could not record the recommendation", err)
 	}
-	return weather.Weather[0].Main
 }
 
 func (h *Handler) NotSunnyEndpoint() func(writer http.ResponseWriter, request *http.Request) {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		defer profile.Duration(time.Now(), "NotSunnyEndpoint")
-		writer.WriteHeader(http.StatusOK)
-		writer.Write([]byte(h.getNotSunnyActivities(request.Context()))) //nolint:errcheck
+		req, err := h.parseRecommendationRequest(request, false)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		recommendation, err := h.getNotSunnyActivities(request.Context(), req)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writeRecommendation(writer, request, recommendation)
 	}
 }
 
-func (h *Handler) getNotSunnyActivities(ctx context.Context) string {
-
-	var a Activities
-	var newActivityList []Activities
-
-	notSunnyActivitiesQuery := "SELECT * FROM activities where sunny = $1"
-	rows, err := h.Db.Query(ctx, notSunnyActivitiesQuery, false)
+func (h *Handler) getNotSunnyActivities(ctx context.Context, req RecommendationRequest) (Recommendation, error) {
+	newActivityList, err := h.repository().Candidates(ctx, req.candidateFilter())
 	if err != nil {
-		log.Fatalln("An error occurred", err)
+		return Recommendation{}, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&a.Name, &a.Postcode, &a.Sunny)
-		if err != nil {
-			log.Fatalln("Error in scanning db rows", err)
+	return h.retrieveActivity(ctx, req, newActivityList)
+}
+
+// weatherFallback says why err means no weather can be had for any
+// candidate, or returns "" if it doesn't.
+func weatherFallback(err error) string {
+	switch {
+	case isCircuitOpen(err):
+		return FallbackCircuitOpen
+	case errors.Is(err, ErrQuotaExhausted):
+		return FallbackQuotaExhausted
+	}
+	return ""
+}
+
+// Discarded is a candidate that was passed over, and why. err is set when
+// the weather for it couldn't be found, NextOpen when it was closed.
+type Discarded struct {
+	Activity Activities
+	Reason   string
+	NextOpen *time.Time
+	err      error
+}
+
+// allWeatherErrors reports whether every candidate was discarded because its
+// weather couldn't be found, rather than because the weather was bad.
+func allWeatherErrors(discarded []Discarded) bool {
+	for _, d := range discarded {
+		if d.err == nil {
+			return false
 		}
-		newActivityList = append(newActivityList, a)
 	}
-	var discardedActivityList []Activities
-	choosenActivity, _ := h.retrieveActivity(ctx, newActivityList, discardedActivityList, false, 0)
-	return fmt.Sprintf("%s %s", choosenActivity.Name, choosenActivity.Postcode)
+	return true
 }
 
-func (h *Handler) RemoveIndex(s []Activities, index int) []Activities {
-	return append(s[:index], s[index+1:]...)
+const defaultMaxWeatherLookups = 10
+
+func (h *Handler) maxWeatherLookups() int {
+	if h.MaxWeatherLookups <= 0 {
+		return defaultMaxWeatherLookups
+	}
+	return h.MaxWeatherLookups
 }
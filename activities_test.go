@@ -0,0 +1,338 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sony/gobreaker"
+)
+
+// recentClient is as much of Redis as RecentHistory needs to report ids
+// as recently recommended. The ids added are noted in added.
+type recentClient struct {
+	redis.Cmdable
+	ids   []string
+	added *[]string
+}
+
+func (c recentClient) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(c.ids, nil)
+}
+
+func (c recentClient) TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	return nil, fn(recentPipe{added: c.added})
+}
+
+type recentPipe struct {
+	redis.Pipeliner
+	added *[]string
+}
+
+func (p recentPipe) ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd {
+	for _, m := range members {
+		if p.added != nil {
+			*p.added = append(*p.added, m.Member.(string))
+		}
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func (p recentPipe) ZRemRangeByScore(ctx context.Context, key, min, max string) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+func (p recentPipe) ZRemRangeByRank(ctx context.Context, key string, start, stop int64) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+func (p recentPipe) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return redis.NewBoolResult(true, nil)
+}
+
+func newTestHandler(provider *FakeWeatherProvider, activityList ...Activities) *Handler {
+	return &Handler{
+		Repository:      NewMemoryActivityRepository(activityList...),
+		WeatherProvider: provider,
+		Strategy:        &RoundRobinStrategy{},
+	}
+}
+
+func TestGetSunnyActivity(t *testing.T) {
+	park := Activities{Name: "Park", Postcode: "BT1 1AA", Sunny: true}
+	beach := Activities{Name: "Beach", Postcode: "BT2 2BB", Sunny: true}
+	zoo := Activities{Name: "Zoo", Postcode: "BT3 3CC", Sunny: true}
+	museum := Activities{Name: "Museum", Postcode: "BT4 4DD", Sunny: false}
+
+	tests := []struct {
+		name          string
+		activities    []Activities
+		weather       map[string]string
+		providerErr   error
+		maxLookups    int
+		recent        []string
+		want          string
+		wantErr       error
+		wantErrText   string
+		wantDiscarded int
+		wantFallback  string
+		wantRepeat    bool
+		wantCalls     int
+	}{
+		{
+			name:          "suitable",
+			activities:    []Activities{park, beach},
+			weather:       map[string]string{"BT1 1AA": "Rain", "BT2 2BB": "Clear"},
+			want:          "Beach",
+			wantDiscarded: 1,
+			wantCalls:     2,
+		},
+		{
+			name:          "all rained out",
+			activities:    []Activities{park, beach, museum},
+			weather:       map[string]string{"BT1 1AA": "Rain", "BT2 2BB": "Snow"},
+			wantErr:       ErrNoActivities,
+			wantErrText:   "none of the 2 candidates suit the weather",
+			wantDiscarded: 2,
+			wantCalls:     2,
+		},
+		{
+			name:       "empty",
+			activities: []Activities{museum},
+			wantErr:    ErrNoActivities,
+		},
+		{
+			name:         "fallback when the circuit is open",
+			activities:   []Activities{park, beach, museum},
+			providerErr:  gobreaker.ErrOpenState,
+			want:         "Museum",
+			wantFallback: FallbackCircuitOpen,
+			wantCalls:    2,
+		},
+		{
+			name:          "skipped past the lookup cap",
+			activities:    []Activities{park, beach, zoo},
+			weather:       map[string]string{"BT1 1AA": "Rain", "BT2 2BB": "Rain", "BT3 3CC": "Clear"},
+			maxLookups:    2,
+			wantErr:       ErrNoActivities,
+			wantErrText:   "gave up after 2 weather lookups",
+			wantDiscarded: 2,
+			wantCalls:     2,
+		},
+		{
+			name:       "recent ones are passed over",
+			activities: []Activities{park, beach},
+			weather:    map[string]string{"BT1 1AA": "Clear", "BT2 2BB": "Clear"},
+			recent:     []string{"1"},
+			want:       "Beach",
+			wantCalls:  2,
+		},
+		{
+			name:          "repeats when there's nothing else",
+			activities:    []Activities{park, beach},
+			weather:       map[string]string{"BT1 1AA": "Clear", "BT2 2BB": "Rain"},
+			recent:        []string{"1"},
+			want:          "Park",
+			wantRepeat:    true,
+			wantDiscarded: 1,
+			wantCalls:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := NewFakeWeatherProvider()
+			for postcode, condition := range tt.weather {
+				provider.SetCondition(postcode, condition)
+			}
+			provider.Err = tt.providerErr
+			h := newTestHandler(provider, tt.activities...)
+			h.MaxWeatherLookups = tt.maxLookups
+			req := RecommendationRequest{Sunny: true}
+			if tt.recent != nil {
+				h.History = &RecentHistory{Client: recentClient{ids: tt.recent}, TTL: time.Hour, Size: 20}
+				req.Session = "session"
+			}
+
+			got, err := h.getSunnyActivity(context.Background(), req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Errorf("got error %q, want it to mention %q", err, tt.wantErrText)
+				}
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			} else if got.Activity.Name != tt.want {
+				t.Errorf("got %s, want %s", got.Activity.Name, tt.want)
+			}
+			if got.Fallback != tt.wantFallback {
+				t.Errorf("got fallback %q, want %q", got.Fallback, tt.wantFallback)
+			}
+			if got.Repeat != tt.wantRepeat {
+				t.Errorf("got repeat %v, want %v", got.Repeat, tt.wantRepeat)
+			}
+			if tt.wantFallback == "" && len(got.Discarded) != tt.wantDiscarded {
+				t.Errorf("got %d discarded, want %d", len(got.Discarded), tt.wantDiscarded)
+			}
+			for _, d := range got.Discarded {
+				if d.Reason == "" {
+					t.Errorf("%s was discarded without a reason", d.Activity.Name)
+				}
+			}
+			if provider.Calls != tt.wantCalls {
+				t.Errorf("got %d weather calls, want %d", provider.Calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	conditions := func(ws ...string) []Activities {
+		var candidates []Activities
+		for i := range ws {
+			candidates = append(candidates, Activities{ID: int64(i + 1), Name: ws[i], Postcode: "BT" + strconv.Itoa(i+1) + " 1AA", Sunny: true})
+		}
+		return candidates
+	}
+	tests := []struct {
+		name          string
+		candidates    []Activities
+		maxLookups    int
+		limit         int
+		wantSuitable  []string
+		wantErr       string
+		wantDiscarded int
+		wantCalls     int
+	}{
+		{
+			name:    "empty",
+			wantErr: "no suitable activities found",
+		},
+		{
+			name:          "rained out",
+			candidates:    conditions("Rain", "Thunderstorm", "Snow"),
+			wantErr:       "none of the 3 candidates suit the weather",
+			wantDiscarded: 3,
+			wantCalls:     3,
+		},
+		{
+			name:          "keeps on until the candidates run out",
+			candidates:    conditions("Rain", "Drizzle", "Snow", "Rain", "Clear"),
+			wantSuitable:  []string{"Clear"},
+			wantDiscarded: 4,
+			wantCalls:     5,
+		},
+		{
+			name:          "stops at the lookup cap",
+			candidates:    conditions("Rain", "Drizzle", "Snow", "Rain", "Clear"),
+			maxLookups:    3,
+			wantErr:       "gave up after 3 weather lookups",
+			wantDiscarded: 3,
+			wantCalls:     3,
+		},
+		{
+			name:          "keeps every suitable one when ranking",
+			candidates:    conditions("Clear", "Rain", "Clouds"),
+			limit:         2,
+			wantSuitable:  []string{"Clear", "Clouds"},
+			wantDiscarded: 1,
+			wantCalls:     3,
+		},
+		{
+			name:          "stops at the first suitable without a limit",
+			candidates:    conditions("Rain", "Clear", "Clouds", "Rain", "Clear", "Clear"),
+			wantSuitable:  []string{"Clear"},
+			wantDiscarded: 1,
+			wantCalls:     4,
+		},
+		{
+			name:          "looks up a batch at a time",
+			candidates:    conditions("Rain", "Rain", "Rain", "Rain", "Rain", "Clear", "Rain", "Rain", "Rain", "Rain"),
+			wantSuitable:  []string{"Clear"},
+			wantDiscarded: 5,
+			wantCalls:     8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := NewFakeWeatherProvider()
+			for _, a := range tt.candidates {
+				provider.SetCondition(a.Postcode, a.Name)
+			}
+			h := newTestHandler(provider)
+			h.MaxWeatherLookups = tt.maxLookups
+			before := append([]Activities(nil), tt.candidates...)
+
+			var ev evaluation
+			var err error
+			if len(tt.candidates) == 0 {
+				_, err = h.retrieveActivity(context.Background(), RecommendationRequest{Sunny: true}, tt.candidates)
+			} else {
+				ev, err = h.evaluate(context.Background(), RecommendationRequest{Sunny: true, Limit: tt.limit}, &RoundRobinStrategy{}, tt.candidates)
+			}
+
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrNoActivities) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want it to mention %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			var suitable []string
+			for _, a := range ev.suitable {
+				suitable = append(suitable, a.Name)
+			}
+			if !reflect.DeepEqual(suitable, tt.wantSuitable) {
+				t.Errorf("got suitable %v, want %v", suitable, tt.wantSuitable)
+			}
+			if len(ev.discarded) != tt.wantDiscarded {
+				t.Errorf("got %d discarded, want %d", len(ev.discarded), tt.wantDiscarded)
+			}
+			for _, d := range ev.discarded {
+				if !strings.Contains(d.Reason, "not suitable") {
+					t.Errorf("%s was discarded for %q", d.Activity.Name, d.Reason)
+				}
+			}
+			if provider.Calls != tt.wantCalls {
+				t.Errorf("got %d weather calls, want %d", provider.Calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(tt.candidates, before) {
+				t.Errorf("the candidates were changed to %v", tt.candidates)
+			}
+		})
+	}
+}
+
+func TestRankedAlternativesAreAllRecorded(t *testing.T) {
+	provider := NewFakeWeatherProvider()
+	provider.Default = &Weather{Weather: []WeatherCondition{{ID: 800, Main: "Clear"}}}
+	h := newTestHandler(provider,
+		Activities{Name: "Park", Postcode: "BT1 1AA", Sunny: true, Rating: 3},
+		Activities{Name: "Beach", Postcode: "BT2 2BB", Sunny: true, Rating: 5},
+		Activities{Name: "Zoo", Postcode: "BT3 3CC", Sunny: true, Rating: 1},
+	)
+	var added []string
+	h.History = &RecentHistory{Client: recentClient{added: &added}, TTL: time.Hour, Size: 20}
+	strategy := &RoundRobinStrategy{}
+	h.Strategy = strategy
+
+	got, err := h.getSunnyActivity(context.Background(), RecommendationRequest{Sunny: true, Session: "session", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Ranked) != 2 || got.Ranked[0].Activity.Name != "Beach" || got.Ranked[1].Activity.Name != "Park" {
+		t.Fatalf("got %+v, want Beach then Park", got.Ranked)
+	}
+	if want := []string{"2", "1"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("the history got %v, want %v", added, want)
+	}
+	if strategy.lastID != 2 {
+		t.Errorf("the strategy last heard of %d, want the best, 2", strategy.lastID)
+	}
+}
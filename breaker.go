@@ -0,0 +1,129 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/sony/gobreaker"
+)
+
+const FallbackCircuitOpen = "weather_circuit_open"
+
+// callProvider makes call through the circuit breaker, when one is
+// configured, once the quota allows. A call the breaker refuses is given
+// back to the quota, since the provider never saw it.
+func (h *Handler) callProvider(ctx context.Context, call func() (interface{}, error)) (interface{}, error) {
+	quota, provider := h.quota(), providerName(h.weatherProvider())
+	if err := quota.Take(ctx, provider); err != nil {
+		return nil, err
+	}
+	if h.CircuitBreaker == nil {
+		return call()
+	}
+	result, err := h.CircuitBreaker.Execute(call)
+	if isCircuitOpen(err) {
+		quota.Refund(ctx, provider)
+	}
+	return result, err
+}
+
+// fetchWeather calls the weather provider through callProvider.
+func (h *Handler) fetchWeather(ctx context.Context, loc Location) (Weather, error) {
+	provider := h.weatherProvider()
+	result, err := h.callProvider(ctx, func() (interface{}, error) {
+		return provider.GetWeather(ctx, loc)
+	})
+	if err != nil {
+		return Weather{}, err
+	}
+	return result.(Weather), nil
+}
+
+// currentWeather returns the weather for loc and whether it came from the
+// cache, checking the cache before asking the provider. When the provider
+// can't be reached the last known weather is served, however old it is.
+func (h *Handler) currentWeather(ctx context.Context, loc Location) (Weather, bool, error) {
+	cache := h.weatherCache()
+	if entry, ok := cache.Get(ctx, loc.Postcode); ok {
+		return entry.Weather, true, nil
+	}
+
+	w, cached, err := h.refreshWeather(ctx, loc)
+	// stale weather stands in when the provider couldn't be reached, not
+	// when it answered for the wrong place
+	var werr *WeatherError
+	if errors.As(err, &werr) && !errors.Is(err, ErrLocationMismatch) {
+		if stale, ok := cache.GetStale(ctx, loc.Postcode); ok {
+			log.Printf("serving weather for %s from %s: %v", loc, stale.FetchedAt, werr.Err)
+			return stale.Weather, true, nil
+		}
+	}
+	if err != nil {
+		return Weather{}, false, err
+	}
+	return w, cached, nil
+}
+
+// refreshWeather fetches the current weather for loc from the provider and
+// caches it, unless another request is already doing so, in which case it
+// returns what that request cached.
+func (h *Handler) refreshWeather(ctx context.Context, loc Location) (Weather, bool, error) {
+	cache := h.weatherCache()
+	v, cached, err := h.coalesce(ctx, "current", loc.Postcode,
+		func(ctx context.Context) (interface{}, bool) {
+			entry, ok := cache.Get(ctx, loc.Postcode)
+			return entry.Weather, ok
+		},
+		func(ctx context.Context) (interface{}, error) {
+			w, err := h.fetchWeather(ctx, loc)
+			if err != nil {
+				return nil, &WeatherError{Postcode: loc.Postcode, Err: err}
+			}
+			if err := checkCoordinates(loc, w.Coord.Lat, w.Coord.Lon); err != nil {
+				return nil, err
+			}
+			if err := cache.Set(ctx, loc.Postcode, w); err != nil {
+				log.Println("could not cache the weather", err)
+			}
+			return w, nil
+		})
+	if err != nil {
+		return Weather{}, false, err
+	}
+	return v.(Weather), cached, nil
+}
+
+func isCircuitOpen(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+type CircuitBreakerStatus struct {
+	Name                 string `json:"name"`
+	State                string `json:"state"`
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures"`
+}
+
+func (h *Handler) CircuitBreakerEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		status := CircuitBreakerStatus{State: "disabled"}
+		if h.CircuitBreaker != nil {
+			counts := h.CircuitBreaker.Counts()
+			status = CircuitBreakerStatus{
+				Name:                 h.CircuitBreaker.Name(),
+				State:                h.CircuitBreaker.State().String(),
+				Requests:             counts.Requests,
+				TotalSuccesses:       counts.TotalSuccesses,
+				TotalFailures:        counts.TotalFailures,
+				ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+				ConsecutiveFailures:  counts.ConsecutiveFailures,
+			}
+		}
+		writeJSON(writer, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,300 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// weatherCacheVersion is part of every key, so changing the shape of
+	// CachedWeather only needs this bumping for old entries to be ignored.
+	weatherCacheVersion = "v1"
+	defaultWeatherTTL   = 10 * time.Minute
+	defaultStaleTTL     = 7 * 24 * time.Hour
+	defaultForecastTTL  = time.Hour
+)
+
+// WeatherCache keeps decoded weather payloads in Redis. Current entries
+// expire after TTL; a last-known copy is kept for StaleTTL so there is
+// something to serve when the provider is down. Forecasts are kept for
+// ForecastTTL. With a nil Client nothing is cached.
+type WeatherCache struct {
+	Client      redis.Cmdable
+	Namespace   string
+	TTL         time.Duration
+	StaleTTL    time.Duration
+	ForecastTTL time.Duration
+}
+
+type CachedWeather struct {
+	Postcode  string    `json:"postcode"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Weather   Weather   `json:"weather"`
+}
+
+func NewWeatherCache(client redis.Cmdable) *WeatherCache {
+	return &WeatherCache{
+		Client:      client,
+		Namespace:   "activities:weather",
+		TTL:         defaultWeatherTTL,
+		StaleTTL:    defaultStaleTTL,
+		ForecastTTL: defaultForecastTTL,
+	}
+}
+
+func (h *Handler) weatherCache() *WeatherCache {
+	if h.WeatherCache == nil {
+		return NewWeatherCache(h.redisClient())
+	}
+	return h.WeatherCache
+}
+
+func (c *WeatherCache) key(kind, postcode string) string {
+	return c.Namespace + ":" + weatherCacheVersion + ":" + kind + ":" + NormalizePostcode(postcode)
+}
+
+func (c *WeatherCache) Get(ctx context.Context, postcode string) (CachedWeather, bool) {
+	return c.get(ctx, c.key("current", postcode))
+}
+
+// GetStale returns the last weather stored for postcode, however old.
+func (c *WeatherCache) GetStale(ctx context.Context, postcode string) (CachedWeather, bool) {
+	return c.get(ctx, c.key("last-known", postcode))
+}
+
+func (c *WeatherCache) get(ctx context.Context, key string) (CachedWeather, bool) {
+	if c.Client == nil {
+		return CachedWeather{}, false
+	}
+	value, err := c.Client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Println("could not read the weather cache", err)
+		}
+		return CachedWeather{}, false
+	}
+	return decodeWeather(value)
+}
+
+func decodeWeather(value []byte) (CachedWeather, bool) {
+	var entry CachedWeather
+	if err := json.Unmarshal(value, &entry); err != nil || len(entry.Weather.Weather) == 0 {
+		return CachedWeather{}, false
+	}
+	return entry, true
+}
+
+// GetMany is Get for several postcodes in one round trip. What's found is
+// keyed by normalized postcode.
+func (c *WeatherCache) GetMany(ctx context.Context, postcodes []string) map[string]CachedWeather {
+	found := make(map[string]CachedWeather)
+	for postcode, value := range c.mget(ctx, "current", postcodes) {
+		if entry, ok := decodeWeather(value); ok {
+			found[postcode] = entry
+		}
+	}
+	return found
+}
+
+// GetForecasts is GetForecast for several postcodes in one round trip.
+// What's found is keyed by normalized postcode.
+func (c *WeatherCache) GetForecasts(ctx context.Context, postcodes []string) map[string]Forecast {
+	found := make(map[string]Forecast)
+	for postcode, value := range c.mget(ctx, "forecast", postcodes) {
+		if forecast, ok := decodeForecast(value); ok {
+			found[postcode] = forecast
+		}
+	}
+	return found
+}
+
+// mget reads the kind of entry for each postcode with a single MGET,
+// returning the values that exist keyed by normalized postcode.
+func (c *WeatherCache) mget(ctx context.Context, kind string, postcodes []string) map[string][]byte {
+	if c.Client == nil || len(postcodes) == 0 {
+		return nil
+	}
+	keys := make([]string, len(postcodes))
+	for i, postcode := range postcodes {
+		keys[i] = c.key(kind, postcode)
+	}
+	values, err := c.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Println("could not read the weather cache", err)
+		return nil
+	}
+	found := make(map[string][]byte, len(values))
+	for i, v := range values {
+		// missing keys come back as nil
+		if s, ok := v.(string); ok {
+			found[NormalizePostcode(postcodes[i])] = []byte(s)
+		}
+	}
+	return found
+}
+
+func (c *WeatherCache) Set(ctx context.Context, postcode string, w Weather) error {
+	if c.Client == nil {
+		return nil
+	}
+	value, err := json.Marshal(CachedWeather{Postcode: NormalizePostcode(postcode), FetchedAt: time.Now().UTC(), Weather: w})
+	if err != nil {
+		return err
+	}
+	_, err = c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, c.key("current", postcode), value, c.TTL)
+		pipe.Set(ctx, c.key("last-known", postcode), value, c.StaleTTL)
+		return nil
+	})
+	return err
+}
+
+// Expiring reports whether the current weather for postcode is missing or
+// will expire within d.
+func (c *WeatherCache) Expiring(ctx context.Context, postcode string, d time.Duration) bool {
+	if c.Client == nil {
+		return true
+	}
+	ttl, err := c.Client.PTTL(ctx, c.key("current", postcode)).Result()
+	if err != nil {
+		log.Println("could not read the weather cache", err)
+		return true
+	}
+	// a missing key has a negative TTL
+	return ttl < d
+}
+
+func (c *WeatherCache) GetForecast(ctx context.Context, postcode string) (Forecast, bool) {
+	if c.Client == nil {
+		return Forecast{}, false
+	}
+	value, err := c.Client.Get(ctx, c.key("forecast", postcode)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Println("could not read the forecast cache", err)
+		}
+		return Forecast{}, false
+	}
+	return decodeForecast(value)
+}
+
+func decodeForecast(value []byte) (Forecast, bool) {
+	var forecast Forecast
+	if err := json.Unmarshal(value, &forecast); err != nil || len(forecast.List) == 0 {
+		return Forecast{}, false
+	}
+	return forecast, true
+}
+
+func (c *WeatherCache) SetForecast(ctx context.Context, postcode string, forecast Forecast) error {
+	if c.Client == nil {
+		return nil
+	}
+	value, err := json.Marshal(forecast)
+	if err != nil {
+		return err
+	}
+	return c.Client.Set(ctx, c.key("forecast", postcode), value, c.ForecastTTL).Err()
+}
+
+type CacheEntry struct {
+	Key        string    `json:"key"`
+	Postcode   string    `json:"postcode"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+	Condition  string    `json:"condition"`
+}
+
+// Entries lists the current entries whose postcode starts with prefix.
+func (c *WeatherCache) Entries(ctx context.Context, prefix string) ([]CacheEntry, error) {
+	entries := []CacheEntry{}
+	err := c.scan(ctx, "current", prefix, func(key string) error {
+		entry, ok := c.get(ctx, key)
+		if !ok {
+			return nil
+		}
+		ttl, err := c.Client.TTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, CacheEntry{
+			Key:        key,
+			Postcode:   entry.Postcode,
+			FetchedAt:  entry.FetchedAt,
+			TTLSeconds: int64(ttl / time.Second),
+			Condition:  entry.Weather.Weather[0].Main,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// Invalidate removes current, last-known and forecast entries whose postcode starts
+// with prefix, returning how many keys were deleted. An empty prefix clears
+// the whole namespace.
+func (c *WeatherCache) Invalidate(ctx context.Context, prefix string) (int64, error) {
+	var deleted int64
+	for _, kind := range []string{"current", "last-known", "forecast"} {
+		err := c.scan(ctx, kind, prefix, func(key string) error {
+			n, err := c.Client.Del(ctx, key).Result()
+			deleted += n
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (c *WeatherCache) scan(ctx context.Context, kind, prefix string, f func(key string) error) error {
+	if c.Client == nil {
+		return nil
+	}
+	prefix = strings.ToUpper(strings.TrimSpace(prefix))
+	match := c.Namespace + ":" + weatherCacheVersion + ":" + kind + ":" + escapeGlob(prefix) + "*"
+	iter := c.Client.Scan(ctx, 0, match, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := f(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// WeatherCacheEndpoint lets the cache be inspected with GET and cleared with
+// DELETE, optionally limited to postcodes starting with ?prefix=.
+func (h *Handler) WeatherCacheEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		prefix := request.URL.Query().Get("prefix")
+		switch request.Method {
+		case http.MethodGet:
+			entries, err := h.weatherCache().Entries(request.Context(), prefix)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, entries)
+		case http.MethodDelete:
+			deleted, err := h.weatherCache().Invalidate(request.Context(), prefix)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, map[string]int64{"deleted": deleted})
+		default:
+			writer.Header().Set("Allow", "GET, DELETE")
+			writeError(writer, ErrMethodNotAllowed)
+		}
+	}
+}
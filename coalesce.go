@@ -0,0 +1,127 @@
+package activities
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// fetchTimeout bounds a shared fetch, which may wait for the quota
+	// as well as the provider's own timeout.
+	fetchTimeout = 15 * time.Second
+	// fetchLockTTL outlasts any fetch, so the lock can't expire while the
+	// holder is still fetching.
+	fetchLockTTL      = fetchTimeout + 5*time.Second
+	fetchPollInterval = 100 * time.Millisecond
+)
+
+// flightGroup runs one call per key at a time; callers asking for a key
+// that's already in flight wait for its result instead of making their own
+// call. The call runs in its own goroutine, so every caller, including the
+// one that started it, can give up waiting without cutting it short for
+// the others.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done   chan struct{}
+	val    interface{}
+	cached bool
+	err    error
+	// joined counts the callers that have asked for the call, under the
+	// group's lock.
+	joined int
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (interface{}, bool, error)) (interface{}, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		c = &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.val, c.cached, c.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.joined++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.cached, c.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// coalesce fetches the kind of weather for postcode at most once at a time
+// across every replica. Within this process concurrent callers share one
+// fetch. Between replicas a short-lived Redis lock decides who fetches,
+// while the others poll the cache for the result, reporting it as cached.
+// Should the lock holder give up without caching anything, or Redis be
+// unreachable or not configured, the fetch is made anyway. The shared work
+// runs on its own context, limited to fetchTimeout, rather than any one
+// caller's, so a caller going away neither fails the others nor counts
+// against the circuit breaker.
+func (h *Handler) coalesce(ctx context.Context, kind, postcode string, cached func(ctx context.Context) (interface{}, bool), fetch func(ctx context.Context) (interface{}, error)) (interface{}, bool, error) {
+	cache := h.weatherCache()
+	return h.flights.do(ctx, cache.key(kind, postcode), func() (interface{}, bool, error) {
+		fetchAlone := func() (interface{}, bool, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+			defer cancel()
+			v, err := fetch(ctx)
+			return v, false, err
+		}
+		if cache.Client == nil {
+			return fetchAlone()
+		}
+
+		// waiting for another replica takes at most as long as its lock
+		ctx, cancel := context.WithTimeout(context.Background(), fetchLockTTL)
+		defer cancel()
+		lockKey := cache.key("lock:"+kind, postcode)
+		lock, ok, err := acquireLock(ctx, cache.Client, lockKey, fetchLockTTL)
+		if err != nil {
+			log.Println("could not take the weather fetch lock", err)
+		}
+		if ok {
+			defer func() {
+				if err := lock.Release(context.Background()); err != nil {
+					log.Println("could not release the weather fetch lock", err)
+				}
+			}()
+		}
+		if err != nil || ok {
+			return fetchAlone()
+		}
+
+		ticker := time.NewTicker(fetchPollInterval)
+		defer ticker.Stop()
+	poll:
+		for {
+			select {
+			case <-ctx.Done():
+				break poll
+			case <-ticker.C:
+			}
+			if v, ok := cached(ctx); ok {
+				return v, true, nil
+			}
+			if n, err := cache.Client.Exists(ctx, lockKey).Result(); err != nil || n == 0 {
+				break poll
+			}
+		}
+		return fetchAlone()
+	})
+}
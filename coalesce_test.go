@@ -0,0 +1,81 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowProvider answers once released, remembering whether the context it
+// was called with had been cancelled by then.
+type slowProvider struct {
+	release   chan struct{}
+	cancelled chan bool
+}
+
+func (p *slowProvider) GetWeather(ctx context.Context, loc Location) (Weather, error) {
+	<-p.release
+	p.cancelled <- ctx.Err() != nil
+	return Weather{Weather: []WeatherCondition{{ID: 800, Main: "Clear"}}}, nil
+}
+
+// waitForJoined waits until n callers have joined the one call in flight.
+func waitForJoined(t *testing.T, h *Handler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.flights.mu.Lock()
+		joined := 0
+		for _, c := range h.flights.calls {
+			joined += c.joined
+		}
+		h.flights.mu.Unlock()
+		if joined == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers joined the fetch, want %d", joined, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescedFetchOutlivesTheCallerThatStartedIt(t *testing.T) {
+	provider := &slowProvider{release: make(chan struct{}), cancelled: make(chan bool, 2)}
+	h := &Handler{WeatherProvider: provider}
+	loc := Location{Postcode: "BT1 1AA"}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := h.refreshWeather(leaderCtx, loc)
+		leader <- err
+	}()
+	waitForJoined(t, h, 1)
+	follower := make(chan error, 1)
+	go func() {
+		w, _, err := h.refreshWeather(context.Background(), loc)
+		if err == nil && w.Weather[0].Main != "Clear" {
+			err = errors.New("got the wrong weather")
+		}
+		follower <- err
+	}()
+
+	waitForJoined(t, h, 2)
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("the leader got %v, want it to stop waiting", err)
+	}
+	close(provider.release)
+	if err := <-follower; err != nil {
+		t.Errorf("the follower got %v", err)
+	}
+	if <-provider.cancelled {
+		t.Error("the fetch was cancelled along with the leader")
+	}
+	if len(provider.cancelled) > 0 {
+		t.Error("the follower made its own fetch")
+	}
+}
@@ -0,0 +1,255 @@
+package activities
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	maxNameLength   = 200
+)
+
+// ActivityInput is the body accepted when creating or replacing an activity.
+// Fields are pointers so a missing field can be told apart from a zero value.
+type ActivityInput struct {
+	Name        *string      `json:"name"`
+	Postcode    *string      `json:"postcode"`
+	Sunny       *bool        `json:"sunny"`
+	Category    string       `json:"category"`
+	Coordinates *Coordinates `json:"coordinates"`
+	Rating      float64      `json:"rating"`
+	// Tags are left as they are on update when missing.
+	Tags               []string      `json:"tags"`
+	OpeningHours       *OpeningHours `json:"opening_hours"`
+	NeedsDaylight      bool          `json:"needs_daylight"`
+	MinDaylightMinutes int           `json:"min_daylight_minutes"`
+}
+
+func (in ActivityInput) validate() (Activities, error) {
+	var verr ValidationError
+	var a Activities
+
+	switch {
+	case in.Name == nil || strings.TrimSpace(*in.Name) == "":
+		verr.add("name", "is required")
+	case len(strings.TrimSpace(*in.Name)) > maxNameLength:
+		verr.add("name", fmt.Sprintf("must be at most %d characters", maxNameLength))
+	default:
+		a.Name = strings.TrimSpace(*in.Name)
+	}
+
+	switch {
+	case in.Postcode == nil || strings.TrimSpace(*in.Postcode) == "":
+		verr.add("postcode", "is required")
+	case !ValidPostcode(*in.Postcode):
+		verr.add("postcode", "is not a valid UK postcode")
+	default:
+		a.Postcode = NormalizePostcode(*in.Postcode)
+	}
+
+	if in.Sunny == nil {
+		verr.add("sunny", "is required")
+	} else {
+		a.Sunny = *in.Sunny
+	}
+
+	if in.Coordinates != nil {
+		if !in.Coordinates.Valid() {
+			verr.add("coordinates", "must be a valid latitude and longitude")
+		}
+		a.Coordinates = in.Coordinates
+	}
+
+	if in.Rating < 0 || in.Rating > 5 {
+		verr.add("rating", "must be between 0 and 5")
+	}
+	a.Rating = in.Rating
+
+	if in.MinDaylightMinutes < 0 || in.MinDaylightMinutes > minutesPerDay {
+		verr.add("min_daylight_minutes", fmt.Sprintf("must be between 0 and %d", minutesPerDay))
+	}
+	a.NeedsDaylight = in.NeedsDaylight
+	a.MinDaylightMinutes = in.MinDaylightMinutes
+
+	if in.OpeningHours != nil {
+		in.OpeningHours.validate(&verr)
+		a.OpeningHours = in.OpeningHours
+	}
+
+	if in.Tags != nil {
+		a.Tags = normalizeTags(in.Tags, "tags", &verr)
+	}
+
+	a.Category = strings.ToLower(strings.TrimSpace(in.Category))
+	if len(a.Category) > maxNameLength {
+		verr.add("category", fmt.Sprintf("must be at most %d characters", maxNameLength))
+	}
+	return a, verr.errOrNil()
+}
+
+type ActivityFilter struct {
+	Sunny *bool
+	// Postcode is the start of the postcodes to list, matched with the
+	// spaces taken out.
+	Postcode string
+	Limit    int
+	Offset   int
+}
+
+type ActivityPage struct {
+	Activities []Activities `json:"activities"`
+	Total      int          `json:"total"`
+	Limit      int          `json:"limit"`
+	Offset     int          `json:"offset"`
+}
+
+func parseActivityFilter(request *http.Request) (ActivityFilter, error) {
+	var verr ValidationError
+	query := request.URL.Query()
+	filter := ActivityFilter{Limit: defaultPageSize}
+
+	if v := query.Get("sunny"); v != "" {
+		sunny, err := strconv.ParseBool(v)
+		if err != nil {
+			verr.add("sunny", "must be true or false")
+		}
+		filter.Sunny = &sunny
+	}
+	if v := strings.TrimSpace(query.Get("postcode")); v != "" {
+		// only a whole postcode can be normalized, "BT7 1" would become "BT71"
+		if ValidPostcode(v) {
+			filter.Postcode = NormalizePostcode(v)
+		} else {
+			filter.Postcode = strings.ToUpper(v)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			verr.add("limit", fmt.Sprintf("must be between 1 and %d", maxPageSize))
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			verr.add("offset", "must be zero or more")
+		}
+		filter.Offset = offset
+	}
+	return filter, verr.errOrNil()
+}
+
+// ActivitiesEndpoint serves /activities: GET lists the catalogue, POST adds
+// to it.
+func (h *Handler) ActivitiesEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			filter, err := parseActivityFilter(request)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			page, err := h.repository().List(request.Context(), filter)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, page)
+		case http.MethodPost:
+			a, err := h.decodeActivity(writer, request)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			if a, err = h.repository().Create(request.Context(), a); err != nil {
+				writeError(writer, err)
+				return
+			}
+			writer.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(request.URL.Path, "/"), a.ID))
+			writeJSON(writer, http.StatusCreated, a)
+		default:
+			writer.Header().Set("Allow", "GET, POST")
+			writeError(writer, ErrMethodNotAllowed)
+		}
+	}
+}
+
+// ActivityEndpoint serves /activities/{id}: GET fetches, PUT replaces and
+// DELETE removes a single activity. It also serves /activities/{id}/tags.
+func (h *Handler) ActivityEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if path.Base(request.URL.Path) == "tags" {
+			h.activityTags(writer, request)
+			return
+		}
+		id, err := strconv.ParseInt(path.Base(request.URL.Path), 10, 64)
+		if err != nil {
+			writeError(writer, ErrActivityNotFound)
+			return
+		}
+		switch request.Method {
+		case http.MethodGet:
+			a, err := h.repository().Get(request.Context(), id)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, a)
+		case http.MethodPut:
+			a, err := h.decodeActivity(writer, request)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			a.ID = id
+			if err := h.repository().Update(request.Context(), a); err != nil {
+				writeError(writer, err)
+				return
+			}
+			// read back, since tags left out of the request are kept
+			a, err = h.repository().Get(request.Context(), id)
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, a)
+		case http.MethodDelete:
+			if err := h.repository().Delete(request.Context(), id); err != nil {
+				writeError(writer, err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.Header().Set("Allow", "GET, PUT, DELETE")
+			writeError(writer, ErrMethodNotAllowed)
+		}
+	}
+}
+
+// decodeActivity reads and validates an activity, looking up its
+// coordinates from the postcode when they weren't given.
+func (h *Handler) decodeActivity(writer http.ResponseWriter, request *http.Request) (Activities, error) {
+	var in ActivityInput
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&in); err != nil {
+		return Activities{}, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	a, err := in.validate()
+	if err != nil {
+		return Activities{}, err
+	}
+	if a.Coordinates == nil {
+		loc := h.locate(request.Context(), a)
+		a.Coordinates = loc.Coordinates
+	}
+	return a, nil
+}
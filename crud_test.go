@@ -0,0 +1,72 @@
+package activities
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateWithoutTagsKeepsThem(t *testing.T) {
+	h := newTestHandler(NewFakeWeatherProvider(), Activities{Name: "Park", Postcode: "BT1 1AA", Sunny: true, Tags: []string{"free", "outdoors"}})
+	body := `{"name": "Big Park", "postcode": "BT1 1AA", "sunny": true}`
+	writer := httptest.NewRecorder()
+	h.ActivityEndpoint()(writer, httptest.NewRequest("PUT", "/activities/1", strings.NewReader(body)))
+	if writer.Code != 200 {
+		t.Fatalf("got status %d: %s", writer.Code, writer.Body)
+	}
+	var got Activities
+	if err := json.Unmarshal(writer.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Big Park" || !reflect.DeepEqual(got.Tags, []string{"free", "outdoors"}) {
+		t.Errorf("got %+v, want the new name with the old tags", got)
+	}
+}
+
+func TestListByPostcodePrefix(t *testing.T) {
+	h := newTestHandler(NewFakeWeatherProvider(),
+		Activities{Name: "Park", Postcode: "BT7 1NN"},
+		Activities{Name: "Zoo", Postcode: "BT7 3AB"},
+		Activities{Name: "Beach", Postcode: "BT9 5AA"},
+	)
+	tests := []struct {
+		postcode string
+		want     []string
+	}{
+		{postcode: "bt7", want: []string{"Park", "Zoo"}},
+		{postcode: "BT7 1", want: []string{"Park"}},
+		{postcode: "bt71n", want: []string{"Park"}},
+		{postcode: "bt71nn", want: []string{"Park"}},
+		{postcode: "BT_", want: nil},
+		{postcode: "%", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.postcode, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			h.ActivitiesEndpoint()(writer, httptest.NewRequest("GET", "/activities?postcode="+url.QueryEscape(tt.postcode), nil))
+			if writer.Code != 200 {
+				t.Fatalf("got status %d: %s", writer.Code, writer.Body)
+			}
+			var page ActivityPage
+			if err := json.Unmarshal(writer.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, a := range page.Activities {
+				got = append(got, a.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if got, want := escapeLike(`BT_1%\`), `BT\_1\%\\`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
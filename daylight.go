@@ -0,0 +1,48 @@
+package activities
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// sunTimes returns sunrise and sunset on the local day of at. Providers
+// only give them for the day the weather was fetched, so for other days
+// they're moved by whole days, which is within a few minutes over the
+// five days a forecast covers.
+func (h *Handler) sunTimes(w Weather, at time.Time) (sunrise, sunset time.Time, ok bool) {
+	if w.Sys.Sunrise == 0 || w.Sys.Sunset == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	zone := h.zoneFor(&w)
+	sunrise = time.Unix(int64(w.Sys.Sunrise), 0).In(zone)
+	sunset = time.Unix(int64(w.Sys.Sunset), 0).In(zone)
+	days := int(math.Round(startOfDay(at.In(zone)).Sub(startOfDay(sunrise)).Hours() / 24))
+	return sunrise.AddDate(0, 0, days), sunset.AddDate(0, 0, days), true
+}
+
+// checkDaylight reports whether there's enough daylight left at at for a,
+// and if not why. Activities that don't need daylight always pass; those
+// that do fail when the weather doesn't say when the sun sets, rather than
+// risk one being suggested in the dark.
+func (h *Handler) checkDaylight(a Activities, w Weather, at time.Time) (bool, string) {
+	if !a.NeedsDaylight {
+		return true, ""
+	}
+	sunrise, sunset, ok := h.sunTimes(w, at)
+	if !ok {
+		return false, "needs daylight, but when the sun sets there isn't known"
+	}
+	if at.Before(sunrise) {
+		return false, "dark until sunrise at " + sunrise.Format("15:04")
+	}
+	if !at.Before(sunset) {
+		return false, "dark after sunset at " + sunset.Format("15:04")
+	}
+	needed := time.Duration(a.MinDaylightMinutes) * time.Minute
+	if left := sunset.Sub(at); left < needed {
+		return false, fmt.Sprintf("only %s of daylight left before sunset at %s, needs %s",
+			left.Truncate(time.Minute), sunset.Format("15:04"), needed)
+	}
+	return true, ""
+}
@@ -0,0 +1,45 @@
+package activities
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDaylight(t *testing.T) {
+	h := &Handler{TimeZone: time.UTC}
+	sunrise := time.Date(2024, 6, 8, 4, 45, 0, 0, time.UTC)
+	sunset := time.Date(2024, 6, 8, 21, 0, 0, 0, time.UTC)
+	known := Weather{}
+	known.Sys.Sunrise = int(sunrise.Unix())
+	known.Sys.Sunset = int(sunset.Unix())
+	hike := Activities{Name: "Hike", NeedsDaylight: true, MinDaylightMinutes: 120}
+
+	tests := []struct {
+		name       string
+		activity   Activities
+		weather    Weather
+		at         time.Time
+		wantOK     bool
+		wantReason string
+	}{
+		{name: "doesn't need daylight", activity: Activities{Name: "Museum"}, at: sunset.Add(2 * time.Hour), wantOK: true},
+		{name: "daytime", activity: hike, weather: known, at: sunrise.Add(6 * time.Hour), wantOK: true},
+		{name: "before sunrise", activity: hike, weather: known, at: sunrise.Add(-time.Hour), wantReason: "dark until sunrise at 04:45"},
+		{name: "after sunset", activity: hike, weather: known, at: sunset.Add(2 * time.Hour), wantReason: "dark after sunset at 21:00"},
+		{name: "too little left", activity: hike, weather: known, at: sunset.Add(-time.Hour), wantReason: "only 1h0m0s of daylight left"},
+		{name: "after sunset days later", activity: hike, weather: known, at: sunset.AddDate(0, 0, 3).Add(2 * time.Hour), wantReason: "dark after sunset"},
+		{name: "sunset unknown", activity: hike, at: sunrise.Add(6 * time.Hour), wantReason: "isn't known"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := h.checkDaylight(tt.activity, tt.weather, tt.at)
+			if ok != tt.wantOK {
+				t.Fatalf("got %v (%q), want %v", ok, reason, tt.wantOK)
+			}
+			if !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("got %q, want it to mention %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package activities
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNoActivities       = errors.New("no suitable activities found")
+	ErrWeatherUnavailable = errors.New("weather unavailable")
+	ErrDatabase           = errors.New("database unavailable")
+	ErrActivityNotFound   = errors.New("activity not found")
+	ErrTagNotFound        = errors.New("tag not found")
+	ErrInvalidInput       = errors.New("invalid input")
+	ErrMethodNotAllowed   = errors.New("method not allowed")
+)
+
+// DatabaseError wraps a failure talking to Postgres. It matches ErrDatabase
+// with errors.Is while keeping the driver error reachable with errors.As.
+type DatabaseError struct {
+	Op  string
+	Err error
+}
+
+func (e *DatabaseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *DatabaseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DatabaseError) Is(target error) bool {
+	return target == ErrDatabase
+}
+
+// WeatherError wraps a failure fetching weather for a postcode. It matches
+// ErrWeatherUnavailable with errors.Is.
+type WeatherError struct {
+	Postcode string
+	Err      error
+}
+
+func (e *WeatherError) Error() string {
+	return fmt.Sprintf("weather for %s: %v", e.Postcode, e.Err)
+}
+
+func (e *WeatherError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WeatherError) Is(target error) bool {
+	return target == ErrWeatherUnavailable
+}
+
+// ValidationError lists the problems with a request body, keyed by field
+// name. It matches ErrInvalidInput with errors.Is.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	var problems []string
+	for field, problem := range e.Fields {
+		problems = append(problems, field+": "+problem)
+	}
+	sort.Strings(problems)
+	return "invalid input: " + strings.Join(problems, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidInput
+}
+
+func (e *ValidationError) add(field, problem string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	e.Fields[field] = problem
+}
+
+func (e *ValidationError) errOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+type ErrorResponse struct {
+	Status  int               `json:"status"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func errorResponse(err error) ErrorResponse {
+	var validation *ValidationError
+	switch {
+	case errors.As(err, &validation):
+		return ErrorResponse{Status: http.StatusBadRequest, Code: "invalid_input", Message: ErrInvalidInput.Error(), Fields: validation.Fields}
+	case errors.Is(err, ErrInvalidInput):
+		return ErrorResponse{Status: http.StatusBadRequest, Code: "invalid_input", Message: err.Error()}
+	case errors.Is(err, ErrMethodNotAllowed):
+		return ErrorResponse{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: err.Error()}
+	case errors.Is(err, ErrRateLimited):
+		return ErrorResponse{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: err.Error()}
+	case errors.Is(err, ErrActivityNotFound), errors.Is(err, ErrTagNotFound):
+		return ErrorResponse{Status: http.StatusNotFound, Code: "not_found", Message: err.Error()}
+	case errors.Is(err, ErrNoActivities):
+		return ErrorResponse{Status: http.StatusNotFound, Code: "no_activities", Message: err.Error()}
+	case errors.Is(err, ErrQuotaExhausted):
+		return ErrorResponse{Status: http.StatusServiceUnavailable, Code: "weather_quota_exhausted", Message: err.Error()}
+	case errors.Is(err, ErrWeatherUnavailable):
+		return ErrorResponse{Status: http.StatusBadGateway, Code: "weather_unavailable", Message: err.Error()}
+	case errors.Is(err, ErrDatabase):
+		return ErrorResponse{Status: http.StatusServiceUnavailable, Code: "database_unavailable", Message: ErrDatabase.Error()}
+	}
+	return ErrorResponse{Status: http.StatusInternalServerError, Code: "internal_error", Message: "internal error"}
+}
+
+func writeError(writer http.ResponseWriter, err error) {
+	resp := errorResponse(err)
+	log.Println("request failed:", err)
+	writeJSON(writer, resp.Status, resp)
+}
@@ -0,0 +1,345 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// maxForecastGap is how far the nearest forecast slot can be from the
+// requested time before the forecast is considered not to cover it.
+const maxForecastGap = 3 * time.Hour
+
+var ErrForecastOutOfRange = fmt.Errorf("%w: no forecast is available for that time", ErrInvalidInput)
+
+// Forecast follows the OpenWeatherMap 5 day / 3 hour forecast format.
+type Forecast struct {
+	Cod     string         `json:"cod"`
+	Message int            `json:"message"`
+	Cnt     int            `json:"cnt"`
+	List    []ForecastItem `json:"list"`
+	City    ForecastCity   `json:"city"`
+}
+
+type ForecastItem struct {
+	Dt   int `json:"dt"`
+	Main struct {
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+		TempMin   float64 `json:"temp_min"`
+		TempMax   float64 `json:"temp_max"`
+		Pressure  int     `json:"pressure"`
+		SeaLevel  int     `json:"sea_level"`
+		GrndLevel int     `json:"grnd_level"`
+		Humidity  int     `json:"humidity"`
+		TempKf    float64 `json:"temp_kf"`
+	} `json:"main"`
+	Weather []WeatherCondition `json:"weather"`
+	Clouds  struct {
+		All int `json:"all"`
+	} `json:"clouds"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+		Deg   int     `json:"deg"`
+		Gust  float64 `json:"gust"`
+	} `json:"wind"`
+	Visibility int     `json:"visibility"`
+	Pop        float64 `json:"pop"`
+	Rain       struct {
+		ThreeHour float64 `json:"3h"`
+	} `json:"rain"`
+	Snow struct {
+		ThreeHour float64 `json:"3h"`
+	} `json:"snow"`
+	Sys struct {
+		Pod string `json:"pod"`
+	} `json:"sys"`
+	DtTxt string `json:"dt_txt"`
+}
+
+type ForecastCity struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Coord struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"coord"`
+	Country    string `json:"country"`
+	Population int    `json:"population"`
+	Timezone   int    `json:"timezone"`
+	Sunrise    int    `json:"sunrise"`
+	Sunset     int    `json:"sunset"`
+}
+
+// ForecastProvider is implemented by weather providers that can look ahead.
+type ForecastProvider interface {
+	GetForecast(ctx context.Context, loc Location) (Forecast, error)
+}
+
+// Nearest returns the forecast slot closest to t.
+func (f Forecast) Nearest(t time.Time) (ForecastItem, error) {
+	var best ForecastItem
+	bestGap := time.Duration(-1)
+	for _, item := range f.List {
+		gap := time.Unix(int64(item.Dt), 0).Sub(t)
+		if gap < 0 {
+			gap = -gap
+		}
+		if bestGap < 0 || gap < bestGap {
+			best, bestGap = item, gap
+		}
+	}
+	if bestGap < 0 || bestGap > maxForecastGap || len(best.Weather) == 0 {
+		return ForecastItem{}, ErrForecastOutOfRange
+	}
+	return best, nil
+}
+
+// AsWeather turns a forecast slot into a Weather so the same rules can be
+// applied to it as to the current conditions.
+func (f Forecast) AsWeather(item ForecastItem) Weather {
+	var w Weather
+	w.Coord.Lat = f.City.Coord.Lat
+	w.Coord.Lon = f.City.Coord.Lon
+	w.Weather = item.Weather
+	w.Main.Temp = item.Main.Temp
+	w.Main.FeelsLike = item.Main.FeelsLike
+	w.Main.TempMin = item.Main.TempMin
+	w.Main.TempMax = item.Main.TempMax
+	w.Main.Pressure = item.Main.Pressure
+	w.Main.Humidity = item.Main.Humidity
+	w.Main.SeaLevel = item.Main.SeaLevel
+	w.Main.GrndLevel = item.Main.GrndLevel
+	w.Visibility = item.Visibility
+	w.Wind.Speed = item.Wind.Speed
+	w.Wind.Deg = item.Wind.Deg
+	w.Wind.Gust = item.Wind.Gust
+	w.Clouds.All = item.Clouds.All
+	w.Dt = item.Dt
+	w.Sys.Country = f.City.Country
+	w.Sys.Sunrise = f.City.Sunrise
+	w.Sys.Sunset = f.City.Sunset
+	w.Timezone = f.City.Timezone
+	w.ID = f.City.ID
+	w.Name = f.City.Name
+	return w
+}
+
+func (o *OpenWeatherMap) GetForecast(ctx context.Context, loc Location) (Forecast, error) {
+	var forecast Forecast
+
+	if err := getJSON(ctx, o.Client, o.BaseURL+"/forecast?"+o.query(loc).Encode(), &forecast); err != nil {
+		return Forecast{}, fmt.Errorf("retrieving the forecast for %s: %w", loc, err)
+	}
+	return forecast, nil
+}
+
+type openMeteoHourly struct {
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	UtcOffsetSeconds int     `json:"utc_offset_seconds"`
+	Hourly           struct {
+		Time                []int     `json:"time"`
+		Temperature2m       []float64 `json:"temperature_2m"`
+		ApparentTemperature []float64 `json:"apparent_temperature"`
+		Weathercode         []int     `json:"weathercode"`
+		Windspeed10m        []float64 `json:"windspeed_10m"`
+		Windgusts10m        []float64 `json:"windgusts_10m"`
+		Winddirection10m    []float64 `json:"winddirection_10m"`
+		Visibility          []float64 `json:"visibility"`
+		Cloudcover          []int     `json:"cloudcover"`
+	} `json:"hourly"`
+	Daily struct {
+		Sunrise []int `json:"sunrise"`
+		Sunset  []int `json:"sunset"`
+	} `json:"daily"`
+}
+
+func (o *OpenMeteo) GetForecast(ctx context.Context, loc Location) (Forecast, error) {
+	place, err := o.geocode(ctx, loc)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	var hourly openMeteoHourly
+	query := url.Values{}
+	query.Set("latitude", fmt.Sprint(place.Latitude))
+	query.Set("longitude", fmt.Sprint(place.Longitude))
+	query.Set("hourly", "temperature_2m,apparent_temperature,weathercode,windspeed_10m,windgusts_10m,winddirection_10m,visibility,cloudcover")
+	query.Set("daily", "sunrise,sunset")
+	query.Set("forecast_days", "6")
+	query.Set("windspeed_unit", "ms")
+	query.Set("timeformat", "unixtime")
+	query.Set("timezone", "auto")
+	if err := getJSON(ctx, o.Client, o.ForecastURL+"?"+query.Encode(), &hourly); err != nil {
+		return Forecast{}, fmt.Errorf("retrieving the forecast for %s: %w", loc, err)
+	}
+
+	forecast := Forecast{Cod: "200"}
+	forecast.City.Name = place.Name
+	forecast.City.Country = place.CountryCode
+	forecast.City.Coord.Lat = hourly.Latitude
+	forecast.City.Coord.Lon = hourly.Longitude
+	forecast.City.Timezone = hourly.UtcOffsetSeconds
+	// like OpenWeatherMap, only the first day's are kept, see sunTimes
+	if len(hourly.Daily.Sunrise) > 0 && len(hourly.Daily.Sunset) > 0 {
+		forecast.City.Sunrise = hourly.Daily.Sunrise[0]
+		forecast.City.Sunset = hourly.Daily.Sunset[0]
+	}
+	h := hourly.Hourly
+	for i, dt := range h.Time {
+		if i >= len(h.Temperature2m) || i >= len(h.ApparentTemperature) || i >= len(h.Weathercode) ||
+			i >= len(h.Windspeed10m) || i >= len(h.Windgusts10m) || i >= len(h.Winddirection10m) ||
+			i >= len(h.Visibility) || i >= len(h.Cloudcover) {
+			break
+		}
+		var item ForecastItem
+		item.Dt = dt
+		item.Main.Temp = h.Temperature2m[i]
+		item.Main.FeelsLike = h.ApparentTemperature[i]
+		item.Weather = []WeatherCondition{wmoCondition(h.Weathercode[i])}
+		item.Wind.Speed = h.Windspeed10m[i]
+		item.Wind.Gust = h.Windgusts10m[i]
+		item.Wind.Deg = int(h.Winddirection10m[i])
+		item.Visibility = int(h.Visibility[i])
+		item.Clouds.All = h.Cloudcover[i]
+		item.DtTxt = time.Unix(int64(dt), 0).UTC().Format("2006-01-02 15:04:05")
+		forecast.List = append(forecast.List, item)
+	}
+	forecast.Cnt = len(forecast.List)
+	return forecast, nil
+}
+
+// GetForecast repeats the configured weather every three hours for five
+// days, unless a forecast has been set for the postcode.
+func (f *FakeWeatherProvider) GetForecast(ctx context.Context, loc Location) (Forecast, error) {
+	f.mu.Lock()
+	forecast, ok := f.Forecasts[loc.Postcode]
+	f.mu.Unlock()
+	if ok {
+		return forecast, nil
+	}
+	w, err := f.GetWeather(ctx, loc)
+	if err != nil {
+		return Forecast{}, err
+	}
+	forecast = Forecast{Cod: "200"}
+	forecast.City.Name = w.Name
+	forecast.City.Timezone = w.Timezone
+	forecast.City.Sunrise = w.Sys.Sunrise
+	forecast.City.Sunset = w.Sys.Sunset
+	forecast.City.Coord.Lat = w.Coord.Lat
+	forecast.City.Coord.Lon = w.Coord.Lon
+	start := time.Now().Truncate(3 * time.Hour)
+	for slot := 0; slot < 40; slot++ {
+		var item ForecastItem
+		item.Dt = int(start.Add(time.Duration(slot) * 3 * time.Hour).Unix())
+		item.Weather = w.Weather
+		item.Main.Temp = w.Main.Temp
+		item.Main.FeelsLike = w.Main.FeelsLike
+		item.Wind.Speed = w.Wind.Speed
+		item.Wind.Gust = w.Wind.Gust
+		item.Visibility = w.Visibility
+		forecast.List = append(forecast.List, item)
+	}
+	forecast.Cnt = len(forecast.List)
+	return forecast, nil
+}
+
+// fetchForecast calls the forecast provider through callProvider.
+func (h *Handler) fetchForecast(ctx context.Context, loc Location) (Forecast, error) {
+	provider, ok := h.weatherProvider().(ForecastProvider)
+	if !ok {
+		return Forecast{}, errors.New("the weather provider doesn't support forecasts")
+	}
+	result, err := h.callProvider(ctx, func() (interface{}, error) {
+		return provider.GetForecast(ctx, loc)
+	})
+	if err != nil {
+		return Forecast{}, err
+	}
+	return result.(Forecast), nil
+}
+
+// forecastWeather returns the forecast weather for loc at the slot nearest
+// to at, and whether the forecast came from the cache.
+func (h *Handler) forecastWeather(ctx context.Context, loc Location, at time.Time) (Weather, bool, error) {
+	cache := h.weatherCache()
+	forecast, cached := cache.GetForecast(ctx, loc.Postcode)
+	if !cached {
+		var err error
+		forecast, cached, err = h.refreshForecast(ctx, loc)
+		if err != nil {
+			return Weather{}, false, err
+		}
+	}
+	item, err := forecast.Nearest(at)
+	if err != nil {
+		return Weather{}, false, err
+	}
+	return forecast.AsWeather(item), cached, nil
+}
+
+// refreshForecast fetches the forecast for loc from the provider and caches
+// it, coalescing with other requests for it like refreshWeather.
+func (h *Handler) refreshForecast(ctx context.Context, loc Location) (Forecast, bool, error) {
+	cache := h.weatherCache()
+	v, cached, err := h.coalesce(ctx, "forecast", loc.Postcode,
+		func(ctx context.Context) (interface{}, bool) {
+			return cache.GetForecast(ctx, loc.Postcode)
+		},
+		func(ctx context.Context) (interface{}, error) {
+			forecast, err := h.fetchForecast(ctx, loc)
+			if err != nil {
+				return nil, &WeatherError{Postcode: loc.Postcode, Err: err}
+			}
+			if err := checkCoordinates(loc, forecast.City.Coord.Lat, forecast.City.Coord.Lon); err != nil {
+				return nil, err
+			}
+			if err := cache.SetForecast(ctx, loc.Postcode, forecast); err != nil {
+				log.Println("could not cache the forecast", err)
+			}
+			return forecast, nil
+		})
+	if err != nil {
+		return Forecast{}, false, err
+	}
+	return v.(Forecast), cached, nil
+}
+
+// weatherAt returns the weather expected at loc at the given time. The zero
+// time, or any time close to now, uses the current conditions.
+func (h *Handler) weatherAt(ctx context.Context, loc Location, at time.Time) (Weather, bool, error) {
+	if isNearNow(at) {
+		return h.currentWeather(ctx, loc)
+	}
+	return h.forecastWeather(ctx, loc, at)
+}
+
+// isNearNow reports whether the current conditions are good enough for at.
+func isNearNow(at time.Time) bool {
+	return at.IsZero() || time.Until(at) < time.Hour
+}
+
+// parseTargetTime reads the ?at= query parameter, which may be an RFC 3339
+// timestamp or a date, meaning midday UTC on that day.
+func parseTargetTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		d, dateErr := time.Parse("2006-01-02", value)
+		if dateErr != nil {
+			return time.Time{}, &ValidationError{Fields: map[string]string{"at": "must be an RFC 3339 time or a YYYY-MM-DD date"}}
+		}
+		t = d.Add(12 * time.Hour)
+	}
+	if t.Before(time.Now().Add(-time.Hour)) {
+		return time.Time{}, &ValidationError{Fields: map[string]string{"at": "must not be in the past"}}
+	}
+	return t, nil
+}
@@ -0,0 +1,35 @@
+package activities
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenMeteoForecastKnowsWhenTheSunSets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if got := request.URL.Query().Get("daily"); got != "sunrise,sunset" {
+			t.Errorf("asked for daily %q, want sunrise,sunset", got)
+		}
+		writer.Write([]byte(`{"latitude": 54.6, "longitude": -5.9, "utc_offset_seconds": 3600,
+			"hourly": {"time": [1717837200], "temperature_2m": [15], "apparent_temperature": [14], "weathercode": [0],
+				"windspeed_10m": [3], "windgusts_10m": [5], "winddirection_10m": [180], "visibility": [10000], "cloudcover": [10]},
+			"daily": {"sunrise": [1717818300, 1717904680], "sunset": [1717878000, 1717964430]}}`))
+	}))
+	defer server.Close()
+	provider := &OpenMeteo{ForecastURL: server.URL, Client: server.Client()}
+
+	forecast, err := provider.GetForecast(context.Background(), Location{Postcode: "BT1 1AA", Coordinates: &Coordinates{Lat: 54.6, Lon: -5.9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forecast.City.Sunrise != 1717818300 || forecast.City.Sunset != 1717878000 {
+		t.Errorf("got sunrise %d and sunset %d, want the first day's", forecast.City.Sunrise, forecast.City.Sunset)
+	}
+	w := forecast.AsWeather(forecast.List[0])
+	if _, _, ok := (&Handler{}).sunTimes(w, time.Unix(int64(forecast.List[0].Dt), 0)); !ok {
+		t.Error("the forecast weather doesn't say when the sun sets")
+	}
+}
@@ -0,0 +1,71 @@
+package activities
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const earthRadiusKm = 6371.0
+
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (c Coordinates) String() string {
+	return fmt.Sprintf("%.5f,%.5f", c.Lat, c.Lon)
+}
+
+func (c Coordinates) Valid() bool {
+	return c.Lat >= -90 && c.Lat <= 90 && c.Lon >= -180 && c.Lon <= 180
+}
+
+// DistanceKm is the great-circle distance between a and b.
+func DistanceKm(a, b Coordinates) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLon := radians(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Location is where to look up the weather. Providers use the coordinates
+// when they're known and search for the postcode otherwise.
+type Location struct {
+	Postcode    string
+	Coordinates *Coordinates
+}
+
+func (a Activities) Location() Location {
+	return Location{Postcode: a.Postcode, Coordinates: a.Coordinates}
+}
+
+func (l Location) String() string {
+	if l.Coordinates != nil {
+		return l.Postcode + " (" + l.Coordinates.String() + ")"
+	}
+	return l.Postcode
+}
+
+// maxCoordinateDriftKm is how far the provider's idea of where it looked up
+// the weather can be from where the activity is before the answer is
+// treated as being for the wrong place.
+const maxCoordinateDriftKm = 25.0
+
+var ErrLocationMismatch = errors.New("weather was returned for a different location")
+
+func checkCoordinates(loc Location, lat, lon float64) error {
+	if loc.Coordinates == nil || (lat == 0 && lon == 0) {
+		return nil
+	}
+	returned := Coordinates{Lat: lat, Lon: lon}
+	if d := DistanceKm(*loc.Coordinates, returned); d > maxCoordinateDriftKm {
+		return &WeatherError{Postcode: loc.Postcode, Err: fmt.Errorf("%w: asked for %s, got %s (%.0fkm away)", ErrLocationMismatch, loc.Coordinates, returned, d)}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package activities
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var ErrUnknownPostcode = errors.New("unknown postcode")
+
+// Geocoder turns a postcode into coordinates.
+type Geocoder interface {
+	Geocode(ctx context.Context, postcode string) (Coordinates, error)
+}
+
+// geocoder returns nil when there is neither a Geocoder nor a database to
+// look postcodes up in.
+func (h *Handler) geocoder() Geocoder {
+	if h.Geocoder == nil {
+		if h.Db == nil {
+			return nil
+		}
+		return &PostgresGeocoder{Pool: h.Db}
+	}
+	return h.Geocoder
+}
+
+// locate fills in an activity's coordinates from the geocoder when they
+// aren't stored, so the weather can still be looked up by lat/lon.
+func (h *Handler) locate(ctx context.Context, a Activities) Location {
+	return h.resolve(ctx, a.Location())
+}
+
+// resolve fills in the coordinates of loc from the geocoder when they
+// aren't known.
+func (h *Handler) resolve(ctx context.Context, loc Location) Location {
+	if loc.Coordinates == nil && h.geocoder() != nil {
+		if c, err := h.geocoder().Geocode(ctx, loc.Postcode); err == nil {
+			loc.Coordinates = &c
+		}
+	}
+	return loc
+}
+
+// PostgresGeocoder looks postcodes up in the postcodes table, which is
+// loaded from the ONS Postcode Directory with ImportONSPD.
+type PostgresGeocoder struct {
+	Pool *pgxpool.Pool
+}
+
+func (g *PostgresGeocoder) Geocode(ctx context.Context, postcode string) (Coordinates, error) {
+	var c Coordinates
+	err := g.Pool.QueryRow(ctx, "SELECT latitude, longitude FROM postcodes WHERE postcode = $1", NormalizePostcode(postcode)).
+		Scan(&c.Lat, &c.Lon)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Coordinates{}, fmt.Errorf("%w: %s", ErrUnknownPostcode, postcode)
+	}
+	if err != nil {
+		return Coordinates{}, &DatabaseError{Op: "geocoding postcode", Err: err}
+	}
+	return c, nil
+}
+
+// Backfill sets the coordinates of every activity that doesn't have them
+// from the postcodes table, returning how many were updated.
+func (g *PostgresGeocoder) Backfill(ctx context.Context) (int64, error) {
+	tag, err := g.Pool.Exec(ctx, `UPDATE activities a SET latitude = p.latitude, longitude = p.longitude
+		FROM postcodes p WHERE p.postcode = a.postcode AND (a.latitude IS NULL OR a.longitude IS NULL)`)
+	if err != nil {
+		return 0, &DatabaseError{Op: "backfilling coordinates", Err: err}
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ImportONSPD loads an ONS Postcode Directory CSV into the postcodes table,
+// replacing the coordinates of postcodes that are already there. Postcodes
+// the directory has no grid reference for are skipped.
+func ImportONSPD(ctx context.Context, pool *pgxpool.Pool, r io.Reader) (int64, error) {
+	src, err := newONSPDSource(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var imported int64
+	err = pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "CREATE TEMP TABLE postcodes_import (LIKE postcodes) ON COMMIT DROP")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"postcodes_import"}, []string{"postcode", "latitude", "longitude"}, src); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `INSERT INTO postcodes (postcode, latitude, longitude)
+			SELECT DISTINCT ON (postcode) postcode, latitude, longitude FROM postcodes_import
+			ON CONFLICT (postcode) DO UPDATE SET latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude`)
+		imported = tag.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, &DatabaseError{Op: "importing postcodes", Err: err}
+	}
+	return imported, nil
+}
+
+// onspdSource streams rows out of the ONSPD CSV for CopyFrom.
+type onspdSource struct {
+	reader                      *csv.Reader
+	postcodeCol, latCol, lonCol int
+	row                         []interface{}
+	err                         error
+}
+
+func newONSPDSource(r io.Reader) (*onspdSource, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the ONSPD header: %w", err)
+	}
+	src := &onspdSource{reader: reader, postcodeCol: -1, latCol: -1, lonCol: -1}
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "pcds":
+			src.postcodeCol = i
+		case "pcd":
+			if src.postcodeCol < 0 {
+				src.postcodeCol = i
+			}
+		case "lat":
+			src.latCol = i
+		case "long":
+			src.lonCol = i
+		}
+	}
+	if src.postcodeCol < 0 || src.latCol < 0 || src.lonCol < 0 {
+		return nil, errors.New("the ONSPD file needs pcds, lat and long columns")
+	}
+	return src, nil
+}
+
+func (s *onspdSource) Next() bool {
+	for {
+		record, err := s.reader.Read()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		lat, latErr := strconv.ParseFloat(record[s.latCol], 64)
+		lon, lonErr := strconv.ParseFloat(record[s.lonCol], 64)
+		// ONSPD uses 99.999999 as the latitude of postcodes without a grid
+		// reference
+		if latErr != nil || lonErr != nil || lat > 90 {
+			continue
+		}
+		s.row = []interface{}{NormalizePostcode(record[s.postcodeCol]), lat, lon}
+		return true
+	}
+}
+
+func (s *onspdSource) Values() ([]interface{}, error) {
+	return s.row, nil
+}
+
+func (s *onspdSource) Err() error {
+	return s.err
+}
+
+// MemoryGeocoder answers from a map of normalized postcodes, for tests.
+type MemoryGeocoder struct {
+	mu        sync.RWMutex
+	Postcodes map[string]Coordinates
+}
+
+func NewMemoryGeocoder() *MemoryGeocoder {
+	return &MemoryGeocoder{Postcodes: make(map[string]Coordinates)}
+}
+
+func (g *MemoryGeocoder) Set(postcode string, c Coordinates) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.Postcodes[NormalizePostcode(postcode)] = c
+}
+
+func (g *MemoryGeocoder) Geocode(ctx context.Context, postcode string) (Coordinates, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	c, ok := g.Postcodes[NormalizePostcode(postcode)]
+	if !ok {
+		return Coordinates{}, fmt.Errorf("%w: %s", ErrUnknownPostcode, postcode)
+	}
+	return c, nil
+}
@@ -0,0 +1,106 @@
+package activities
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultHistoryTTL  = 24 * time.Hour
+	defaultHistorySize = 20
+	maxSessionLength   = 128
+)
+
+// RecentHistory remembers which activities each session was recommended
+// lately, so they aren't suggested again straight away. A session keeps
+// its Size most recent activities, and forgets them after TTL. With a nil
+// Client nothing is remembered.
+type RecentHistory struct {
+	Client    redis.Cmdable
+	Namespace string
+	TTL       time.Duration
+	Size      int
+}
+
+func NewRecentHistory(client redis.Cmdable) *RecentHistory {
+	return &RecentHistory{
+		Client:    client,
+		Namespace: "activities:recent",
+		TTL:       defaultHistoryTTL,
+		Size:      defaultHistorySize,
+	}
+}
+
+func (h *Handler) history() *RecentHistory {
+	if h.History == nil {
+		return NewRecentHistory(h.redisClient())
+	}
+	return h.History
+}
+
+func (r *RecentHistory) key(session string) string {
+	return r.Namespace + ":" + session
+}
+
+// Recent returns the ids of the activities session was recently
+// recommended. Nothing is returned when Redis can't be reached.
+func (r *RecentHistory) Recent(ctx context.Context, session string) map[int64]bool {
+	if r.Client == nil {
+		return nil
+	}
+	since := time.Now().Add(-r.TTL).UnixMilli()
+	members, err := r.Client.ZRangeByScore(ctx, r.key(session), &redis.ZRangeBy{
+		Min: strconv.FormatInt(since, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		log.Println("could not read the recommendation history", err)
+		return nil
+	}
+	recent := make(map[int64]bool, len(members))
+	for _, m := range members {
+		if id, err := strconv.ParseInt(m, 10, 64); err == nil {
+			recent[id] = true
+		}
+	}
+	return recent
+}
+
+// Add records that session was recommended the activities, dropping the
+// oldest entries beyond Size.
+func (r *RecentHistory) Add(ctx context.Context, session string, activityList ...Activities) error {
+	if r.Client == nil || len(activityList) == 0 {
+		return nil
+	}
+	key := r.key(session)
+	now := time.Now()
+	members := make([]*redis.Z, len(activityList))
+	for i, a := range activityList {
+		members[i] = &redis.Z{Score: float64(now.UnixMilli()), Member: strconv.FormatInt(a.ID, 10)}
+	}
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, members...)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(now.Add(-r.TTL).UnixMilli(), 10))
+		pipe.ZRemRangeByRank(ctx, key, 0, int64(-r.Size-1))
+		pipe.Expire(ctx, key, r.TTL)
+		return nil
+	})
+	return err
+}
+
+// splitRecent separates the candidates session hasn't been recommended
+// lately from those it has.
+func splitRecent(candidates []Activities, recent map[int64]bool) (fresh, repeats []Activities) {
+	for _, a := range candidates {
+		if recent[a.ID] {
+			repeats = append(repeats, a)
+		} else {
+			fresh = append(fresh, a)
+		}
+	}
+	return fresh, repeats
+}
@@ -0,0 +1,274 @@
+package activities
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	// how far ahead to look for the next opening, enough to get past a
+	// long seasonal closure
+	maxOpeningSearchDays = 366
+)
+
+// defaultTimeZone is where opening hours are evaluated when the weather
+// doesn't say otherwise, since every activity has a UK postcode.
+var defaultTimeZone = loadTimeZone("Europe/London")
+
+func loadTimeZone(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("could not load the %s time zone, using UTC: %v", name, err)
+		return time.UTC
+	}
+	return loc
+}
+
+func (h *Handler) timeZone() *time.Location {
+	if h.TimeZone == nil {
+		return defaultTimeZone
+	}
+	return h.TimeZone
+}
+
+// zoneFor is where an activity with weather w is, judged by the offset the
+// provider reported, falling back to the configured zone.
+func (h *Handler) zoneFor(w *Weather) *time.Location {
+	if w != nil && w.Timezone != 0 {
+		return time.FixedZone("", w.Timezone)
+	}
+	return h.timeZone()
+}
+
+// OpeningHours says when an activity is open, in its local time. Weekly is
+// keyed by lower case day name; days that are missing are closed, but a
+// nil Weekly means open all day every day. No activity is open on a
+// closure date.
+type OpeningHours struct {
+	Weekly   map[string][]OpeningPeriod `json:"weekly,omitempty"`
+	Closures []Closure                  `json:"closures,omitempty"`
+}
+
+// OpeningPeriod is a time of day, as "15:04", the activity opens and when
+// it closes. Closes may be "24:00", or earlier than Opens for a period that
+// runs past midnight.
+type OpeningPeriod struct {
+	Opens  string `json:"opens"`
+	Closes string `json:"closes"`
+}
+
+// Closure is a date, as "2006-01-02", the activity is closed all day.
+type Closure struct {
+	Date   string `json:"date"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// parseClock turns "15:04" into minutes since midnight.
+func parseClock(clock string) (int, bool) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, false
+	}
+	hours, herr := strconv.Atoi(parts[0])
+	minutes, merr := strconv.Atoi(parts[1])
+	if herr != nil || merr != nil || minutes > 59 || hours*60+minutes > minutesPerDay {
+		return 0, false
+	}
+	return hours*60 + minutes, true
+}
+
+// validate checks o, making the day names lower case.
+func (o *OpeningHours) validate(verr *ValidationError) {
+	if o.Weekly != nil {
+		weekly := make(map[string][]OpeningPeriod, len(o.Weekly))
+		for day, periods := range o.Weekly {
+			day = strings.ToLower(strings.TrimSpace(day))
+			weekly[day] = append(weekly[day], periods...)
+		}
+		o.Weekly = weekly
+	}
+	for day, periods := range o.Weekly {
+		if _, ok := weekdays[day]; !ok {
+			verr.add("opening_hours", fmt.Sprintf("%q is not a day of the week", day))
+			continue
+		}
+		for _, p := range periods {
+			opens, ok1 := parseClock(p.Opens)
+			closes, ok2 := parseClock(p.Closes)
+			if !ok1 || !ok2 || opens == closes || opens == minutesPerDay {
+				verr.add("opening_hours", fmt.Sprintf("%s %s-%s is not a valid period", day, p.Opens, p.Closes))
+			}
+		}
+	}
+	for _, c := range o.Closures {
+		if _, err := time.Parse("2006-01-02", c.Date); err != nil {
+			verr.add("opening_hours", fmt.Sprintf("closure %q is not a date like 2006-01-02", c.Date))
+		}
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (o *OpeningHours) closedOn(day time.Time) (Closure, bool) {
+	date := day.Format("2006-01-02")
+	for _, c := range o.Closures {
+		if c.Date == date {
+			return c, true
+		}
+	}
+	return Closure{}, false
+}
+
+// periods lists when the activity is open on the day starting at midnight,
+// as times, ignoring closures.
+func (o *OpeningHours) periods(midnight time.Time) [][2]time.Time {
+	if o.Weekly == nil {
+		return [][2]time.Time{{midnight, midnight.AddDate(0, 0, 1)}}
+	}
+	var periods [][2]time.Time
+	for day, ps := range o.Weekly {
+		if weekday, ok := weekdays[day]; !ok || weekday != midnight.Weekday() {
+			continue
+		}
+		for _, p := range ps {
+			opens, ok1 := parseClock(p.Opens)
+			closes, ok2 := parseClock(p.Closes)
+			if !ok1 || !ok2 {
+				continue
+			}
+			if closes <= opens {
+				closes += minutesPerDay
+			}
+			// built from the date so DST changes don't shift the clock
+			at := func(minutes int) time.Time {
+				return time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, minutes, 0, 0, midnight.Location())
+			}
+			periods = append(periods, [2]time.Time{at(opens), at(closes)})
+		}
+	}
+	return periods
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// OpenAt reports whether the activity is open at t, in t's location, and
+// if so when it next closes. A nil OpeningHours is always open. A period
+// running past midnight into a closure date ends at midnight.
+func (o *OpeningHours) OpenAt(t time.Time) (bool, time.Time) {
+	if o == nil {
+		return true, time.Time{}
+	}
+	today := startOfDay(t)
+	if _, closed := o.closedOn(today); closed {
+		return false, time.Time{}
+	}
+	// yesterday's periods can run on past midnight
+	for _, midnight := range []time.Time{today.AddDate(0, 0, -1), today} {
+		if _, closed := o.closedOn(midnight); closed {
+			continue
+		}
+		for _, p := range o.periods(midnight) {
+			if !t.Before(p[0]) && t.Before(p[1]) {
+				closes := p[1]
+				tomorrow := midnight.AddDate(0, 0, 1)
+				if _, closed := o.closedOn(tomorrow); closed && closes.After(tomorrow) {
+					closes = tomorrow
+				}
+				return true, closes
+			}
+		}
+	}
+	return false, time.Time{}
+}
+
+// NextOpen returns when the activity next opens after t, or false if it
+// doesn't within a year.
+func (o *OpeningHours) NextOpen(t time.Time) (time.Time, bool) {
+	if o == nil {
+		return t, true
+	}
+	midnight := startOfDay(t)
+	for day := 0; day < maxOpeningSearchDays; day++ {
+		if _, closed := o.closedOn(midnight); !closed {
+			var next time.Time
+			for _, p := range o.periods(midnight) {
+				if p[0].After(t) && (next.IsZero() || p[0].Before(next)) {
+					next = p[0]
+				}
+			}
+			if !next.IsZero() {
+				return next, true
+			}
+		}
+		midnight = startOfDay(midnight.Add(36 * time.Hour))
+	}
+	return time.Time{}, false
+}
+
+// closedReason explains why an activity isn't open at t, and when it next
+// opens if that's known.
+func (o *OpeningHours) closedReason(t time.Time) (string, *time.Time) {
+	reason := "closed at " + t.Format("Mon 15:04")
+	if c, closed := o.closedOn(startOfDay(t)); closed {
+		reason = "closed on " + c.Date
+		if c.Reason != "" {
+			reason += " for " + c.Reason
+		}
+	}
+	next, ok := o.NextOpen(t)
+	if !ok {
+		return reason, nil
+	}
+	return reason, &next
+}
+
+// openCandidates splits candidates into those open at the time asked for
+// and those that aren't, which are returned as discarded with when they
+// next open.
+func (h *Handler) openCandidates(req RecommendationRequest, candidates []Activities) ([]Activities, []Discarded) {
+	at := req.targetTime().In(h.timeZone())
+	var open []Activities
+	var closed []Discarded
+	for _, a := range candidates {
+		if ok, _ := a.OpeningHours.OpenAt(at); ok {
+			open = append(open, a)
+			continue
+		}
+		reason, next := a.OpeningHours.closedReason(at)
+		closed = append(closed, Discarded{Activity: a, Reason: reason, NextOpen: next})
+	}
+	return open, closed
+}
+
+// targetTime is when the caller wants to do the activity.
+func (req RecommendationRequest) targetTime() time.Time {
+	if req.At.IsZero() {
+		return time.Now()
+	}
+	return req.At
+}
+
+// soonestOpening is the earliest time any of the closed activities opens.
+func soonestOpening(closed []Discarded) *time.Time {
+	var soonest *time.Time
+	for _, d := range closed {
+		if d.NextOpen != nil && (soonest == nil || d.NextOpen.Before(*soonest)) {
+			soonest = d.NextOpen
+		}
+	}
+	return soonest
+}
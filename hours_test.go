@@ -0,0 +1,155 @@
+package activities
+
+import (
+	"testing"
+	"time"
+)
+
+// pubHours opens late on Fridays, past midnight, and until midnight on
+// Saturdays, but not on the Saturday of a private party.
+var pubHours = &OpeningHours{
+	Weekly: map[string][]OpeningPeriod{
+		"friday":   {{Opens: "20:00", Closes: "02:00"}},
+		"saturday": {{Opens: "12:00", Closes: "24:00"}},
+	},
+	Closures: []Closure{{Date: "2024-06-15", Reason: "a private party"}},
+}
+
+func london(t *testing.T, value string) time.Time {
+	t.Helper()
+	at, err := time.ParseInLocation("2006-01-02 15:04", value, defaultTimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+func TestOpenAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		hours      *OpeningHours
+		at         string
+		wantOpen   bool
+		wantCloses string
+	}{
+		{name: "always open", at: "2024-06-09 03:00", wantOpen: true},
+		{name: "open", hours: pubHours, at: "2024-06-07 21:00", wantOpen: true, wantCloses: "2024-06-08 02:00"},
+		{name: "past midnight", hours: pubHours, at: "2024-06-08 01:30", wantOpen: true, wantCloses: "2024-06-08 02:00"},
+		{name: "at closing", hours: pubHours, at: "2024-06-08 02:00"},
+		{name: "before opening", hours: pubHours, at: "2024-06-08 11:59"},
+		{name: "until 24:00", hours: pubHours, at: "2024-06-08 23:59", wantOpen: true, wantCloses: "2024-06-09 00:00"},
+		{name: "after 24:00", hours: pubHours, at: "2024-06-09 00:00"},
+		{name: "day not listed", hours: pubHours, at: "2024-06-10 21:00"},
+		{name: "into a closure", hours: pubHours, at: "2024-06-14 23:00", wantOpen: true, wantCloses: "2024-06-15 00:00"},
+		{name: "closure after an overnight period", hours: pubHours, at: "2024-06-15 01:00"},
+		{name: "closure", hours: pubHours, at: "2024-06-15 13:00"},
+		{name: "no days", hours: &OpeningHours{Weekly: map[string][]OpeningPeriod{}}, at: "2024-06-08 13:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open, closes := tt.hours.OpenAt(london(t, tt.at))
+			if open != tt.wantOpen {
+				t.Fatalf("got open %v, want %v", open, tt.wantOpen)
+			}
+			if tt.wantCloses == "" {
+				if !closes.IsZero() {
+					t.Errorf("got closing at %v, want none", closes)
+				}
+			} else if want := london(t, tt.wantCloses); !closes.Equal(want) {
+				t.Errorf("got closing at %v, want %v", closes, want)
+			}
+		})
+	}
+}
+
+func TestNextOpen(t *testing.T) {
+	sundayMornings := &OpeningHours{Weekly: map[string][]OpeningPeriod{"sunday": {{Opens: "10:00", Closes: "12:00"}}}}
+	mondays := map[string][]OpeningPeriod{"monday": {{Opens: "09:00", Closes: "17:00"}}}
+	// every Monday from 2024-06-10 for the weeks given
+	closedMondays := func(weeks int) []Closure {
+		var closures []Closure
+		monday := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < weeks; i++ {
+			closures = append(closures, Closure{Date: monday.AddDate(0, 0, 7*i).Format("2006-01-02")})
+		}
+		return closures
+	}
+
+	tests := []struct {
+		name  string
+		hours *OpeningHours
+		after string
+		want  string
+	}{
+		{name: "later the same week", hours: pubHours, after: "2024-06-09 10:00", want: "2024-06-14 20:00"},
+		{name: "while open", hours: pubHours, after: "2024-06-07 21:00", want: "2024-06-08 12:00"},
+		{name: "past a closure", hours: pubHours, after: "2024-06-14 23:00", want: "2024-06-21 20:00"},
+		{name: "into summer time", hours: sundayMornings, after: "2024-03-30 12:00", want: "2024-03-31 10:00"},
+		{name: "into winter time", hours: sundayMornings, after: "2024-10-26 12:00", want: "2024-10-27 10:00"},
+		{name: "after the short day", hours: &OpeningHours{Weekly: mondays}, after: "2024-03-31 00:30", want: "2024-04-01 09:00"},
+		{name: "after the long day", hours: &OpeningHours{Weekly: mondays}, after: "2024-10-27 00:30", want: "2024-10-28 09:00"},
+		{
+			name:  "a long seasonal closure",
+			hours: &OpeningHours{Weekly: mondays, Closures: closedMondays(40)},
+			after: "2024-06-09 12:00",
+			want:  "2025-03-17 09:00",
+		},
+		{name: "closed for over a year", hours: &OpeningHours{Weekly: mondays, Closures: closedMondays(60)}, after: "2024-06-09 12:00"},
+		{name: "no days", hours: &OpeningHours{Weekly: map[string][]OpeningPeriod{}}, after: "2024-06-09 12:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, ok := tt.hours.NextOpen(london(t, tt.after))
+			if tt.want == "" {
+				if ok {
+					t.Errorf("got %v, want it never to open", next)
+				}
+				return
+			}
+			if want := london(t, tt.want); !ok || !next.Equal(want) {
+				t.Errorf("got %v, %v, want %v", next, ok, want)
+			}
+		})
+	}
+}
+
+func TestClosedReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		hours      *OpeningHours
+		at         string
+		wantReason string
+		wantNext   string
+	}{
+		{name: "outside the hours", hours: pubHours, at: "2024-06-09 10:00", wantReason: "closed at Sun 10:00", wantNext: "2024-06-14 20:00"},
+		{
+			name:       "closure",
+			hours:      pubHours,
+			at:         "2024-06-15 13:00",
+			wantReason: "closed on 2024-06-15 for a private party",
+			wantNext:   "2024-06-21 20:00",
+		},
+		{
+			name:       "closure after an overnight period",
+			hours:      pubHours,
+			at:         "2024-06-15 01:00",
+			wantReason: "closed on 2024-06-15 for a private party",
+			wantNext:   "2024-06-21 20:00",
+		},
+		{name: "never opens", hours: &OpeningHours{Weekly: map[string][]OpeningPeriod{}}, at: "2024-06-09 10:00", wantReason: "closed at Sun 10:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, next := tt.hours.closedReason(london(t, tt.at))
+			if reason != tt.wantReason {
+				t.Errorf("got %q, want %q", reason, tt.wantReason)
+			}
+			switch {
+			case tt.wantNext == "" && next != nil:
+				t.Errorf("got next open %v, want none", next)
+			case tt.wantNext != "" && (next == nil || !next.Equal(london(t, tt.wantNext))):
+				t.Errorf("got next open %v, want %s", next, tt.wantNext)
+			}
+		})
+	}
+}
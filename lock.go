@@ -0,0 +1,58 @@
+package activities
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisLock is a lock held in a single Redis key, so that only one replica
+// does a piece of work at a time. It expires after its TTL, so a replica
+// that dies while holding it can't block the others for long.
+type redisLock struct {
+	client redis.Cmdable
+	key    string
+	token  string
+	ttl    time.Duration
+}
+
+// the value is checked before the key is touched, so a lock that expired
+// and was taken by someone else is left alone
+var (
+	refreshLockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	releaseLockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// acquireLock takes the lock at key if nobody holds it, reporting whether
+// it did.
+func acquireLock(ctx context.Context, client redis.Cmdable, key string, ttl time.Duration) (*redisLock, bool, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, false, err
+	}
+	l := &redisLock{client: client, key: key, token: hex.EncodeToString(token), ttl: ttl}
+	ok, err := client.SetNX(ctx, key, l.token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return l, true, nil
+}
+
+// Refresh extends the lock by its TTL, reporting false if it has been lost.
+func (l *redisLock) Refresh(ctx context.Context) (bool, error) {
+	n, err := refreshLockScript.Run(ctx, l.client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (l *redisLock) Release(ctx context.Context) error {
+	return releaseLockScript.Run(ctx, l.client, []string{l.key}, l.token).Err()
+}
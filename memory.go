@@ -0,0 +1,210 @@
+package activities
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryActivityRepository keeps activities in memory, for tests and local
+// development without Postgres.
+type MemoryActivityRepository struct {
+	mu         sync.RWMutex
+	nextID     int64
+	activities map[int64]Activities
+	tags       map[string]bool
+}
+
+func NewMemoryActivityRepository(activities ...Activities) *MemoryActivityRepository {
+	r := &MemoryActivityRepository{activities: make(map[int64]Activities), tags: make(map[string]bool)}
+	for _, a := range activities {
+		r.Create(context.Background(), a) //nolint:errcheck
+	}
+	return r
+}
+
+// sorted returns the activities matching keep ordered by id.
+func (r *MemoryActivityRepository) sorted(keep func(Activities) bool) []Activities {
+	var activityList []Activities
+	for _, a := range r.activities {
+		if keep(a) {
+			activityList = append(activityList, a)
+		}
+	}
+	sort.Slice(activityList, func(i, j int) bool { return activityList[i].ID < activityList[j].ID })
+	return activityList
+}
+
+func (r *MemoryActivityRepository) ListBySunny(ctx context.Context, sunny bool) ([]Activities, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sorted(func(a Activities) bool { return a.Sunny == sunny }), nil
+}
+
+func (r *MemoryActivityRepository) Candidates(ctx context.Context, filter CandidateFilter) ([]Activities, error) {
+	r.mu.RLock()
+	activityList := r.sorted(func(a Activities) bool {
+		return a.Sunny == filter.Sunny && hasTags(a, filter.Include, filter.Exclude)
+	})
+	r.mu.RUnlock()
+	if filter.Near == nil {
+		return activityList, nil
+	}
+	return withinRadius(activityList, *filter.Near, filter.RadiusKm), nil
+}
+
+func (r *MemoryActivityRepository) List(ctx context.Context, filter ActivityFilter) (ActivityPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	matches := r.sorted(func(a Activities) bool {
+		if filter.Sunny != nil && a.Sunny != *filter.Sunny {
+			return false
+		}
+		return strings.HasPrefix(compactPostcode(a.Postcode), compactPostcode(filter.Postcode))
+	})
+
+	page := ActivityPage{Activities: []Activities{}, Total: len(matches), Limit: filter.Limit, Offset: filter.Offset}
+	if filter.Offset < len(matches) {
+		end := len(matches)
+		if filter.Limit > 0 && filter.Offset+filter.Limit < end {
+			end = filter.Offset + filter.Limit
+		}
+		page.Activities = matches[filter.Offset:end]
+	}
+	return page, nil
+}
+
+func (r *MemoryActivityRepository) Get(ctx context.Context, id int64) (Activities, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.activities[id]
+	if !ok {
+		return Activities{}, ErrActivityNotFound
+	}
+	return a, nil
+}
+
+func (r *MemoryActivityRepository) Create(ctx context.Context, a Activities) (Activities, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	a.ID = r.nextID
+	r.addTags(a.Tags)
+	r.activities[a.ID] = a
+	return a, nil
+}
+
+func (r *MemoryActivityRepository) Update(ctx context.Context, a Activities) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.activities[a.ID]
+	if !ok {
+		return ErrActivityNotFound
+	}
+	if a.Tags == nil {
+		a.Tags = existing.Tags
+	}
+	r.addTags(a.Tags)
+	r.activities[a.ID] = a
+	return nil
+}
+
+func (r *MemoryActivityRepository) Delete(ctx context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.activities[id]; !ok {
+		return ErrActivityNotFound
+	}
+	delete(r.activities, id)
+	return nil
+}
+
+func (r *MemoryActivityRepository) Locations(ctx context.Context) ([]Location, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[string]int)
+	var locations []Location
+	for _, a := range r.sorted(func(Activities) bool { return true }) {
+		key := NormalizePostcode(a.Postcode)
+		i, ok := seen[key]
+		if !ok {
+			seen[key] = len(locations)
+			locations = append(locations, a.Location())
+			continue
+		}
+		if locations[i].Coordinates == nil {
+			locations[i].Coordinates = a.Coordinates
+		}
+	}
+	return locations, nil
+}
+
+func (r *MemoryActivityRepository) addTags(tags []string) {
+	for _, tag := range tags {
+		r.tags[tag] = true
+	}
+}
+
+func (r *MemoryActivityRepository) Tags(ctx context.Context) ([]Tag, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]int, len(r.tags))
+	for _, a := range r.activities {
+		for _, tag := range a.Tags {
+			counts[tag]++
+		}
+	}
+	tags := []Tag{}
+	for name := range r.tags {
+		tags = append(tags, Tag{Name: name, Activities: counts[name]})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (r *MemoryActivityRepository) CreateTag(ctx context.Context, name string) (Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags[name] = true
+	t := Tag{Name: name}
+	for _, a := range r.activities {
+		if hasTags(a, []string{name}, nil) {
+			t.Activities++
+		}
+	}
+	return t, nil
+}
+
+func (r *MemoryActivityRepository) DeleteTag(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.tags[name] {
+		return ErrTagNotFound
+	}
+	delete(r.tags, name)
+	for id, a := range r.activities {
+		var kept []string
+		for _, tag := range a.Tags {
+			if tag != name {
+				kept = append(kept, tag)
+			}
+		}
+		a.Tags = kept
+		r.activities[id] = a
+	}
+	return nil
+}
+
+func (r *MemoryActivityRepository) SetTags(ctx context.Context, id int64, tags []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.activities[id]
+	if !ok {
+		return ErrActivityNotFound
+	}
+	a.Tags = append([]string(nil), tags...)
+	r.addTags(a.Tags)
+	r.activities[id] = a
+	return nil
+}
@@ -0,0 +1,8 @@
+-- The table predates the migrations, so this only creates it on an empty
+-- database. There is deliberately no down script: the migrator didn't
+-- necessarily create the table, so it mustn't drop it.
+CREATE TABLE IF NOT EXISTS activities (
+    name     text    NOT NULL,
+    postcode text    NOT NULL,
+    sunny    boolean NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS activities_sunny_idx;
+ALTER TABLE activities DROP COLUMN IF EXISTS id;
@@ -0,0 +1,2 @@
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS id bigserial PRIMARY KEY;
+CREATE INDEX IF NOT EXISTS activities_sunny_idx ON activities (sunny);
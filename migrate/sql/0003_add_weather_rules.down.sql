@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS weather_rules;
+ALTER TABLE activities DROP COLUMN IF EXISTS category;
@@ -0,0 +1,11 @@
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT '';
+
+-- A rule with neither activity_id nor category replaces the default rule.
+CREATE TABLE IF NOT EXISTS weather_rules (
+    id          bigserial PRIMARY KEY,
+    activity_id bigint REFERENCES activities (id) ON DELETE CASCADE,
+    category    text,
+    rule        jsonb NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS weather_rules_activity_idx ON weather_rules (activity_id) WHERE activity_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS weather_rules_category_idx ON weather_rules (category) WHERE category IS NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE activities DROP COLUMN IF EXISTS longitude;
+ALTER TABLE activities DROP COLUMN IF EXISTS latitude;
+DROP TABLE IF EXISTS postcodes;
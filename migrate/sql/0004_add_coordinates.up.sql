@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS postcodes (
+    postcode  text PRIMARY KEY,
+    latitude  double precision NOT NULL,
+    longitude double precision NOT NULL
+);
+
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS latitude double precision;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS longitude double precision;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS activities_coordinates_idx;
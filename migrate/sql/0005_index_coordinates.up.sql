@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS activities_coordinates_idx ON activities (latitude, longitude);
@@ -0,0 +1 @@
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS rating real NOT NULL DEFAULT 0;
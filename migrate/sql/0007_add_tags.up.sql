@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS tags (
+    id   bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS activity_tags (
+    activity_id bigint NOT NULL REFERENCES activities (id) ON DELETE CASCADE,
+    tag_id      bigint NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (activity_id, tag_id)
+);
+CREATE INDEX IF NOT EXISTS activity_tags_tag_idx ON activity_tags (tag_id);
@@ -0,0 +1,2 @@
+-- NULL means always open; see OpeningHours for the shape of the document.
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS opening_hours jsonb;
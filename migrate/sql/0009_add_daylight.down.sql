@@ -0,0 +1,2 @@
+ALTER TABLE activities DROP COLUMN IF EXISTS min_daylight_minutes;
+ALTER TABLE activities DROP COLUMN IF EXISTS needs_daylight;
@@ -0,0 +1,2 @@
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS needs_daylight boolean NOT NULL DEFAULT false;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS min_daylight_minutes integer NOT NULL DEFAULT 0;
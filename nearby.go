@@ -0,0 +1,161 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultRadiusKm = 25.0
+	maxRadiusKm     = 500.0
+	kmPerDegreeLat  = 111.32
+)
+
+// BoundingBox is a lat/lon rectangle around a point, cheap to check in SQL
+// before the exact distance is worked out.
+type BoundingBox struct {
+	MinLat, MaxLat, MinLon, MaxLon float64
+}
+
+func NewBoundingBox(centre Coordinates, radiusKm float64) BoundingBox {
+	dLat := radiusKm / kmPerDegreeLat
+	box := BoundingBox{
+		MinLat: math.Max(-90, centre.Lat-dLat),
+		MaxLat: math.Min(90, centre.Lat+dLat),
+		MinLon: -180,
+		MaxLon: 180,
+	}
+	// near the poles a degree of longitude is too short for a box to help
+	if cos := math.Cos(radians(centre.Lat)); cos > 0.01 {
+		dLon := radiusKm / (kmPerDegreeLat * cos)
+		if dLon < 180 {
+			box.MinLon = centre.Lon - dLon
+			box.MaxLon = centre.Lon + dLon
+		}
+	}
+	return box
+}
+
+// withinRadius keeps the activities that have coordinates no further than
+// radiusKm from centre.
+func withinRadius(activityList []Activities, centre Coordinates, radiusKm float64) []Activities {
+	var nearby []Activities
+	for _, a := range activityList {
+		if a.Coordinates != nil && DistanceKm(centre, *a.Coordinates) <= radiusKm {
+			nearby = append(nearby, a)
+		}
+	}
+	return nearby
+}
+
+// parseRecommendationRequest reads the query parameters shared by the
+// recommendation endpoints: at, postcode or lat/lon, radius in km, strategy,
+// limit, include and exclude tags, and session, which may also come from
+// the X-Session-ID header.
+func (h *Handler) parseRecommendationRequest(request *http.Request, sunny bool) (RecommendationRequest, error) {
+	var verr ValidationError
+	query := request.URL.Query()
+	req := RecommendationRequest{Sunny: sunny, RadiusKm: defaultRadiusKm, Strategy: query.Get("strategy")}
+	if _, err := h.strategy(req.Strategy); err != nil {
+		return RecommendationRequest{}, err
+	}
+
+	at, err := parseTargetTime(query.Get("at"))
+	if err != nil {
+		return RecommendationRequest{}, err
+	}
+	req.At = at
+
+	req.Session = query.Get("session")
+	if req.Session == "" {
+		req.Session = request.Header.Get("X-Session-ID")
+	}
+	if len(req.Session) > maxSessionLength {
+		verr.add("session", fmt.Sprintf("must be at most %d characters", maxSessionLength))
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAlternatives {
+			verr.add("limit", fmt.Sprintf("must be between 1 and %d", maxAlternatives))
+		}
+		req.Limit = limit
+	}
+
+	if err := h.parseArea(request, &req, &verr); err != nil {
+		return RecommendationRequest{}, err
+	}
+	return req, verr.errOrNil()
+}
+
+// parseArea reads where to look into req: postcode or lat/lon, radius in
+// km, and include and exclude tags. Problems with them are added to verr;
+// only a failure to geocode the postcode is returned.
+func (h *Handler) parseArea(request *http.Request, req *RecommendationRequest, verr *ValidationError) error {
+	query := request.URL.Query()
+	req.Include = queryTags(query, "include", verr)
+	req.Exclude = queryTags(query, "exclude", verr)
+
+	if v := query.Get("radius"); v != "" {
+		radius, err := strconv.ParseFloat(v, 64)
+		if err != nil || radius <= 0 || radius > maxRadiusKm {
+			verr.add("radius", fmt.Sprintf("must be a distance in km up to %.0f", maxRadiusKm))
+		}
+		req.RadiusKm = radius
+	}
+
+	lat, lon := query.Get("lat"), query.Get("lon")
+	switch {
+	case lat != "" || lon != "":
+		var c Coordinates
+		var latErr, lonErr error
+		c.Lat, latErr = strconv.ParseFloat(lat, 64)
+		c.Lon, lonErr = strconv.ParseFloat(lon, 64)
+		if latErr != nil || lonErr != nil || !c.Valid() {
+			verr.add("lat", "lat and lon must both be given as decimal degrees")
+		}
+		req.Near = &c
+	case query.Get("postcode") != "":
+		postcode := query.Get("postcode")
+		if !ValidPostcode(postcode) {
+			verr.add("postcode", "is not a valid UK postcode")
+			break
+		}
+		c, err := h.geocodePostcode(request.Context(), postcode)
+		if errors.Is(err, ErrUnknownPostcode) {
+			verr.add("postcode", "could not be found")
+			break
+		}
+		if err != nil {
+			return err
+		}
+		req.Near = &c
+	}
+	return nil
+}
+
+func (h *Handler) geocodePostcode(ctx context.Context, postcode string) (Coordinates, error) {
+	geocoder := h.geocoder()
+	if geocoder == nil {
+		return Coordinates{}, fmt.Errorf("%w: %s", ErrUnknownPostcode, postcode)
+	}
+	return geocoder.Geocode(ctx, postcode)
+}
+
+// distanceFrom is how far a is from where the caller is, when both are known.
+func distanceFrom(req RecommendationRequest, a Activities) *float64 {
+	if req.Near == nil || a.Coordinates == nil {
+		return nil
+	}
+	d := math.Round(DistanceKm(*req.Near, *a.Coordinates)*10) / 10
+	return &d
+}
+
+// candidateFilter turns a request into the repository query for it.
+func (req RecommendationRequest) candidateFilter() CandidateFilter {
+	return CandidateFilter{Sunny: req.Sunny, Near: req.Near, RadiusKm: req.RadiusKm, Include: req.Include, Exclude: req.Exclude}
+}
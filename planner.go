@@ -0,0 +1,566 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matthewboyd/activities/profile"
+)
+
+const (
+	defaultPlanFrom  = "09:00"
+	defaultPlanTo    = "21:00"
+	defaultPlanSlots = 3
+	maxPlanSlots     = 6
+	// the shortest slot worth planning an activity for
+	minPlanSlot = time.Hour
+	// how many of the options for each slot, the nearest to the start, the
+	// route is chosen from
+	maxPlanOptions = 6
+	// what a leg counts for when choosing the route, if where either end is
+	// isn't known, so activities that can't be placed are planned last
+	unknownLegKm = 2 * maxRadiusKm
+)
+
+// FallbackForecastOutOfRange is the Itinerary.Fallback when some of the day
+// is too far ahead to forecast, so it's planned indoors.
+const FallbackForecastOutOfRange = "forecast_out_of_range"
+
+// PlanRequest asks for a day out: one activity for each slot, near where
+// the caller starts.
+type PlanRequest struct {
+	RecommendationRequest
+	Date  time.Time
+	Slots []PlanSlot
+}
+
+// PlanSlot is part of the day to fill with one activity.
+type PlanSlot struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// Itinerary is a day's plan, with how far there is to travel between stops.
+type Itinerary struct {
+	Date            string          `json:"date"`
+	Start           *Coordinates    `json:"start"`
+	Stops           []ItineraryStop `json:"stops"`
+	TotalDistanceKm float64         `json:"total_distance_km"`
+	Fallback        string          `json:"fallback,omitempty"`
+}
+
+// ItineraryStop is the activity planned for a slot. Outdoor stops carry the
+// forecast there; indoor stops carry the forecast that ruled the nearest
+// outdoor activity out, if there was one, and why. A slot nothing suits
+// has no activity, only a reason.
+type ItineraryStop struct {
+	Slot     string          `json:"slot"`
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Name     string          `json:"name,omitempty"`
+	Postcode string          `json:"postcode,omitempty"`
+	Outdoor  bool            `json:"outdoor"`
+	Dry      bool            `json:"dry"`
+	Weather  *WeatherSummary `json:"weather,omitempty"`
+	TravelKm *float64        `json:"travel_km,omitempty"`
+	ClosesAt *time.Time      `json:"closes_at,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+}
+
+// slotName calls a slot after the part of the day it starts in.
+func slotName(from time.Time) string {
+	switch {
+	case from.Hour() < 12:
+		return "morning"
+	case from.Hour() < 17:
+		return "afternoon"
+	}
+	return "evening"
+}
+
+// isDry reports whether w has no rain, drizzle, snow or thunderstorms.
+func isDry(w Weather) bool {
+	for _, condition := range w.Weather {
+		if condition.ID >= 200 && condition.ID < 700 {
+			return false
+		}
+	}
+	return len(w.Weather) > 0
+}
+
+// parsePlanRequest reads date, as YYYY-MM-DD, the from and to times of day
+// the plan covers, as 15:04, how many slots to split that into, and where to
+// look, as parseArea reads it. A start location is required. Parameters of
+// the recommendation endpoints that mean nothing for a plan, like at, limit
+// and strategy, are ignored. Slots that are already over are left out.
+func (h *Handler) parsePlanRequest(request *http.Request) (PlanRequest, error) {
+	var verr ValidationError
+	query := request.URL.Query()
+	req := PlanRequest{RecommendationRequest: RecommendationRequest{RadiusKm: defaultRadiusKm}}
+	if err := h.parseArea(request, &req.RecommendationRequest, &verr); err != nil {
+		return PlanRequest{}, err
+	}
+	if req.Near == nil && verr.Fields["lat"] == "" && verr.Fields["postcode"] == "" {
+		verr.add("postcode", "a start postcode, or lat and lon, is required")
+	}
+
+	zone := h.timeZone()
+	today := startOfDay(time.Now().In(zone))
+	date, err := time.ParseInLocation("2006-01-02", query.Get("date"), zone)
+	switch {
+	case err != nil:
+		verr.add("date", "must be a date like 2006-01-02")
+	case date.Before(today):
+		verr.add("date", "must not be in the past")
+	}
+	req.Date = date
+
+	clock := func(name, fallback string) int {
+		v := query.Get(name)
+		if v == "" {
+			v = fallback
+		}
+		minutes, ok := parseClock(v)
+		if !ok {
+			verr.add(name, "must be a time of day like 15:04")
+		}
+		return minutes
+	}
+	from, to := clock("from", defaultPlanFrom), clock("to", defaultPlanTo)
+	if to <= from {
+		verr.add("to", "must be after from")
+	}
+
+	slots := defaultPlanSlots
+	if v := query.Get("slots"); v != "" {
+		slots, err = strconv.Atoi(v)
+		if err != nil || slots < 1 || slots > maxPlanSlots {
+			verr.add("slots", fmt.Sprintf("must be between 1 and %d", maxPlanSlots))
+		}
+	}
+	if err := verr.errOrNil(); err != nil {
+		return PlanRequest{}, err
+	}
+
+	length := time.Duration(to-from) * time.Minute / time.Duration(slots)
+	if length < minPlanSlot {
+		verr.add("slots", "would make each slot shorter than an hour")
+		return PlanRequest{}, verr.errOrNil()
+	}
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, from, 0, 0, zone)
+	now := time.Now()
+	for i := 0; i < slots; i++ {
+		slot := PlanSlot{From: start.Add(time.Duration(i) * length), To: start.Add(time.Duration(i+1) * length)}
+		if !slot.To.After(now) {
+			continue
+		}
+		if slot.From.Before(now) {
+			slot.From = now.In(zone).Truncate(time.Minute)
+		}
+		slot.Name = slotName(slot.From)
+		req.Slots = append(req.Slots, slot)
+	}
+	if len(req.Slots) == 0 {
+		verr.add("to", "the time asked for is already over")
+	}
+	return req, verr.errOrNil()
+}
+
+// planOption is an activity that suits a slot. Outdoor options carry the
+// weather at the start of the slot, and whether it stays dry throughout.
+type planOption struct {
+	activity Activities
+	weather  *Weather
+	dry      bool
+	closesAt time.Time
+}
+
+// slotChoice is what could fill a slot: the outdoor options, which are
+// planned first, and the indoor ones for when none of those is left. stop
+// describes the slot for when no outdoor option is planned.
+type slotChoice struct {
+	stop    ItineraryStop
+	outdoor []planOption
+	indoor  []planOption
+}
+
+// Plan fills each slot of req with an activity. A slot is given an outdoor
+// activity when one suits the forecast throughout it, and is open and light
+// enough at its start, and an indoor one when none does. Of the ways to do
+// that without planning any activity twice, Plan takes the one that fills
+// the most slots with the least travelling from req.Near, trying every
+// combination of the nearest few options for each slot. When no weather can
+// be had for anywhere, or some of the day is too far ahead to forecast,
+// those slots are planned indoors, with Fallback saying why.
+func (h *Handler) Plan(ctx context.Context, req PlanRequest) (Itinerary, error) {
+	outdoorFilter := req.candidateFilter()
+	outdoorFilter.Sunny = true
+	outdoor, err := h.repository().Candidates(ctx, outdoorFilter)
+	if err != nil {
+		return Itinerary{}, err
+	}
+	indoorFilter := req.candidateFilter()
+	indoorFilter.Sunny = false
+	indoor, err := h.repository().Candidates(ctx, indoorFilter)
+	if err != nil {
+		return Itinerary{}, err
+	}
+	if len(outdoor) == 0 && len(indoor) == 0 {
+		return Itinerary{}, ErrNoActivities
+	}
+
+	// the nearest are looked up first, in case there are more than the limit
+	sort.SliceStable(outdoor, func(i, j int) bool {
+		return planDistance(req.Near, outdoor[i]) < planDistance(req.Near, outdoor[j])
+	})
+	var forecasts map[string]forecastResult
+	if len(outdoor) > 0 {
+		forecasts = h.prefetchForecasts(ctx, outdoor, h.maxWeatherLookups())
+		if err := ctx.Err(); err != nil {
+			return Itinerary{}, err
+		}
+	}
+
+	itinerary := Itinerary{Date: req.Date.Format("2006-01-02"), Start: req.Near, Stops: []ItineraryStop{}}
+	choices := make([]slotChoice, len(req.Slots))
+	for i, slot := range req.Slots {
+		options, stop, err := h.outdoorOptions(slot, outdoor, forecasts, req.Near)
+		if reason := planFallback(err); reason != "" {
+			if itinerary.Fallback == "" {
+				itinerary.Fallback = reason
+			}
+		} else if err != nil {
+			return Itinerary{}, err
+		}
+		choices[i] = slotChoice{
+			stop:    stop,
+			outdoor: nearestOptions(options, req.Near),
+			indoor:  nearestOptions(h.indoorOptions(slot, indoor), req.Near),
+		}
+	}
+
+	previous := req.Near
+	for i, chosen := range shortestRoute(choices, req.Near) {
+		stop := choices[i].stop
+		if (chosen == nil || chosen.weather == nil) && len(choices[i].outdoor) > 0 {
+			stop.Reason = "every outdoor activity that suits is already planned"
+		}
+		if chosen == nil {
+			if stop.Reason == "" {
+				stop.Reason = "nothing suitable is open then"
+			} else {
+				stop.Reason += ", and nothing indoors is open then"
+			}
+			itinerary.Stops = append(itinerary.Stops, stop)
+			continue
+		}
+		if chosen.weather != nil {
+			stop.Outdoor = true
+			stop.Weather = newWeatherSummary(chosen.weather)
+			stop.Dry = chosen.dry
+			stop.Reason = ""
+		}
+		stop.Name = chosen.activity.Name
+		stop.Postcode = chosen.activity.Postcode
+		if !chosen.closesAt.IsZero() && chosen.closesAt.Before(stop.To) {
+			closesAt := chosen.closesAt
+			stop.ClosesAt = &closesAt
+		}
+		if previous != nil && chosen.activity.Coordinates != nil {
+			d := math.Round(DistanceKm(*previous, *chosen.activity.Coordinates)*10) / 10
+			stop.TravelKm = &d
+			itinerary.TotalDistanceKm += d
+		}
+		if chosen.activity.Coordinates != nil {
+			previous = chosen.activity.Coordinates
+		}
+		itinerary.Stops = append(itinerary.Stops, stop)
+	}
+	itinerary.TotalDistanceKm = math.Round(itinerary.TotalDistanceKm*10) / 10
+
+	for _, stop := range itinerary.Stops {
+		if stop.Name != "" {
+			return itinerary, nil
+		}
+	}
+	return itinerary, fmt.Errorf("%w: nothing is open in any of the %d slots", ErrNoActivities, len(req.Slots))
+}
+
+// planFallback says why err means a slot is planned indoors without regard
+// to the weather, or returns "" if it doesn't.
+func planFallback(err error) string {
+	if errors.Is(err, ErrForecastOutOfRange) {
+		return FallbackForecastOutOfRange
+	}
+	return weatherFallback(err)
+}
+
+type forecastResult struct {
+	forecast Forecast
+	err      error
+}
+
+// prefetchForecasts is prefetchWeather for whole forecasts, so a day can be
+// planned from one lookup for each postcode.
+func (h *Handler) prefetchForecasts(ctx context.Context, candidates []Activities, limit int) map[string]forecastResult {
+	results := make(map[string]forecastResult)
+	distinct, postcodes := distinctPostcodes(candidates)
+	cached := h.weatherCache().GetForecasts(ctx, postcodes)
+	var mu sync.Mutex
+	var toFetch []Activities
+	for _, a := range distinct {
+		key := NormalizePostcode(a.Postcode)
+		if forecast, ok := cached[key]; ok {
+			results[key] = forecastResult{forecast: forecast}
+		} else if len(toFetch) < limit {
+			toFetch = append(toFetch, a)
+		}
+	}
+
+	skipped := h.fetchEach(ctx, toFetch, func(a Activities) {
+		forecast, _, err := h.refreshForecast(ctx, h.locate(ctx, a))
+		mu.Lock()
+		results[NormalizePostcode(a.Postcode)] = forecastResult{forecast: forecast, err: err}
+		mu.Unlock()
+	})
+	for _, a := range skipped {
+		results[NormalizePostcode(a.Postcode)] = forecastResult{err: ctx.Err()}
+	}
+	return results
+}
+
+// slotForecast is the weather forecast for each step from the start of slot
+// to its end: the step nearest the start, then every later one before the
+// end. It's ErrForecastOutOfRange when there's no step near the slot.
+func slotForecast(forecast Forecast, slot PlanSlot) ([]Weather, error) {
+	var steps []Weather
+	if nearest, err := forecast.Nearest(slot.From); err == nil && time.Unix(int64(nearest.Dt), 0).Before(slot.From) {
+		steps = append(steps, forecast.AsWeather(nearest))
+	}
+	for _, item := range forecast.List {
+		at := time.Unix(int64(item.Dt), 0)
+		if !at.Before(slot.From) && at.Before(slot.To) && len(item.Weather) > 0 {
+			steps = append(steps, forecast.AsWeather(item))
+		}
+	}
+	if len(steps) == 0 {
+		nearest, err := forecast.Nearest(slot.From)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, forecast.AsWeather(nearest))
+	}
+	return steps, nil
+}
+
+// outdoorOptions lists the outdoor activities that suit the forecast at
+// every step of slot, and are open and light enough at its start. The stop
+// it returns describes the weather at the outdoor activity nearest start
+// that was ruled out, for when none suit. Should no outdoor activity have a
+// forecast for the slot, because no weather can be had for anywhere or the
+// slot is too far ahead, the error saying so is returned.
+func (h *Handler) outdoorOptions(slot PlanSlot, outdoor []Activities, forecasts map[string]forecastResult, start *Coordinates) ([]planOption, ItineraryStop, error) {
+	stop := ItineraryStop{Slot: slot.Name, From: slot.From, To: slot.To}
+	var options []planOption
+	var rejected *Activities
+	var fallbackErr error
+	forecasted := false
+	for i, a := range outdoor {
+		result, ok := forecasts[NormalizePostcode(a.Postcode)]
+		if !ok {
+			continue
+		}
+		if result.err != nil {
+			if weatherFallback(result.err) != "" && fallbackErr == nil {
+				fallbackErr = result.err
+			}
+			continue
+		}
+		steps, err := slotForecast(result.forecast, slot)
+		if err != nil {
+			if fallbackErr == nil {
+				fallbackErr = err
+			}
+			continue
+		}
+		forecasted = true
+		w := steps[0]
+		dry := true
+		reason := ""
+		for _, step := range steps {
+			dry = dry && isDry(step)
+			if ok, why := h.rules().For(a).Evaluate(step); !ok && reason == "" {
+				w = step
+				reason = why + " at " + time.Unix(int64(step.Dt), 0).In(h.zoneFor(&step)).Format("15:04")
+			}
+		}
+		if reason == "" {
+			if ok, why := h.checkDaylight(a, w, slot.From); !ok {
+				reason = why
+			} else {
+				at := slot.From.In(h.zoneFor(&w))
+				open, closesAt := a.OpeningHours.OpenAt(at)
+				if open {
+					options = append(options, planOption{activity: a, weather: &w, dry: dry, closesAt: closesAt})
+					continue
+				}
+				reason, _ = a.OpeningHours.closedReason(at)
+			}
+		}
+		if rejected == nil || planDistance(start, a) < planDistance(start, *rejected) {
+			rejected = &outdoor[i]
+			stop.Weather = newWeatherSummary(&w)
+			stop.Dry = dry
+			stop.Reason = fmt.Sprintf("%s ruled out: %s", a.Name, reason)
+		}
+	}
+	if !forecasted && fallbackErr != nil {
+		return nil, stop, fallbackErr
+	}
+	return options, stop, nil
+}
+
+// indoorOptions lists the indoor activities open at the start of slot.
+func (h *Handler) indoorOptions(slot PlanSlot, indoor []Activities) []planOption {
+	at := slot.From.In(h.timeZone())
+	var options []planOption
+	for _, a := range indoor {
+		if open, closesAt := a.OpeningHours.OpenAt(at); open {
+			options = append(options, planOption{activity: a, closesAt: closesAt})
+		}
+	}
+	return options
+}
+
+// nearestOptions keeps the maxPlanOptions of options nearest from, the
+// better rated first when they're as near.
+func nearestOptions(options []planOption, from *Coordinates) []planOption {
+	sort.SliceStable(options, func(i, j int) bool {
+		di, dj := planDistance(from, options[i].activity), planDistance(from, options[j].activity)
+		if di != dj {
+			return di < dj
+		}
+		return options[i].activity.Rating > options[j].activity.Rating
+	})
+	if len(options) > maxPlanOptions {
+		options = options[:maxPlanOptions]
+	}
+	return options
+}
+
+// shortestRoute picks an option for each slot, nil where there's none to
+// be had, so that no activity is planned twice and a slot gets an outdoor
+// option whenever one is left for it. Of those routes it returns the one
+// filling the most slots, then with the least travelling from start, then
+// with the best rated activities. Every route is tried, which the limits on
+// slots and options keep to a few tens of thousands.
+func shortestRoute(choices []slotChoice, start *Coordinates) []*planOption {
+	var best []*planOption
+	bestFilled, bestKm, bestRating := -1, 0.0, 0.0
+	route := make([]*planOption, 0, len(choices))
+	used := make(map[int64]bool)
+
+	var search func(from *Coordinates, filled int, km, rating float64)
+	search = func(from *Coordinates, filled int, km, rating float64) {
+		i := len(route)
+		// travelling only adds up, so stop once this can't do better
+		most := filled + len(choices) - i
+		if most < bestFilled || (most == bestFilled && km > bestKm) {
+			return
+		}
+		if i == len(choices) {
+			if filled > bestFilled || km < bestKm || (km == bestKm && rating > bestRating) {
+				best = append(best[:0], route...)
+				bestFilled, bestKm, bestRating = filled, km, rating
+			}
+			return
+		}
+		options := unused(choices[i].outdoor, used)
+		if len(options) == 0 {
+			options = unused(choices[i].indoor, used)
+		}
+		if len(options) == 0 {
+			route = append(route, nil)
+			search(from, filled, km, rating)
+			route = route[:i]
+			return
+		}
+		for j := range options {
+			o := &options[j]
+			next := from
+			if o.activity.Coordinates != nil {
+				next = o.activity.Coordinates
+			}
+			used[o.activity.ID] = true
+			route = append(route, o)
+			search(next, filled+1, km+legKm(from, o.activity), rating+o.activity.Rating)
+			route = route[:i]
+			delete(used, o.activity.ID)
+		}
+	}
+	search(start, 0, 0, 0)
+	return best
+}
+
+func unused(options []planOption, used map[int64]bool) []planOption {
+	var remaining []planOption
+	for _, o := range options {
+		if !used[o.activity.ID] {
+			remaining = append(remaining, o)
+		}
+	}
+	return remaining
+}
+
+// planDistance is how far a is from from, or infinitely far when either
+// isn't known, so activities without coordinates are planned last.
+func planDistance(from *Coordinates, a Activities) float64 {
+	if from == nil || a.Coordinates == nil {
+		return math.Inf(1)
+	}
+	return DistanceKm(*from, *a.Coordinates)
+}
+
+// legKm is planDistance for choosing a route, where a leg that can't be
+// measured has to count for something finite.
+func legKm(from *Coordinates, a Activities) float64 {
+	if from == nil || a.Coordinates == nil {
+		return unknownLegKm
+	}
+	return DistanceKm(*from, *a.Coordinates)
+}
+
+// PlanEndpoint serves GET /plan, a day's itinerary: see parsePlanRequest
+// for the parameters and Plan for how it's chosen.
+func (h *Handler) PlanEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		defer profile.Duration(time.Now(), "PlanEndpoint")
+		if request.Method != http.MethodGet {
+			writer.Header().Set("Allow", "GET")
+			writeError(writer, ErrMethodNotAllowed)
+			return
+		}
+		req, err := h.parsePlanRequest(request)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		itinerary, err := h.Plan(request.Context(), req)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		if itinerary.Fallback != "" {
+			writer.Header().Set("X-Activity-Fallback", itinerary.Fallback)
+		}
+		writeJSON(writer, http.StatusOK, itinerary)
+	}
+}
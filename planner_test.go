@@ -0,0 +1,231 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sony/gobreaker"
+)
+
+// hourlyForecast forecasts Clear every three hours from start for a day,
+// with rain in the steps at the times given.
+func hourlyForecast(start time.Time, rainAt ...time.Time) Forecast {
+	var forecast Forecast
+	for step := 0; step < 8; step++ {
+		at := start.Add(time.Duration(step) * 3 * time.Hour)
+		item := ForecastItem{Dt: int(at.Unix())}
+		item.Weather = []WeatherCondition{{ID: 800, Main: "Clear"}}
+		for _, rain := range rainAt {
+			if rain.Equal(at) {
+				item.Weather = []WeatherCondition{{ID: 500, Main: "Rain"}}
+			}
+		}
+		forecast.List = append(forecast.List, item)
+	}
+	return forecast
+}
+
+func TestPlanWeather(t *testing.T) {
+	park := Activities{ID: 1, Name: "Park", Postcode: "BT1 1AA", Sunny: true}
+	museum := Activities{ID: 2, Name: "Museum", Postcode: "BT2 2BB"}
+	start := time.Now().Add(24 * time.Hour).Truncate(3 * time.Hour)
+
+	tests := []struct {
+		name         string
+		from         time.Time
+		rainAt       []time.Time
+		want         string
+		wantFallback string
+		wantReason   string
+	}{
+		{
+			name: "dry all afternoon",
+			from: start,
+			want: "Park",
+		},
+		{
+			name:       "rain later in the slot",
+			from:       start,
+			rainAt:     []time.Time{start.Add(6 * time.Hour)},
+			want:       "Museum",
+			wantReason: "Park ruled out",
+		},
+		{
+			name:   "rain once the slot is over",
+			from:   start,
+			rainAt: []time.Time{start.Add(9 * time.Hour)},
+			want:   "Park",
+		},
+		{
+			name:         "beyond the forecast",
+			from:         start.Add(7 * 24 * time.Hour),
+			want:         "Museum",
+			wantFallback: FallbackForecastOutOfRange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := NewFakeWeatherProvider()
+			provider.Forecasts = map[string]Forecast{park.Postcode: hourlyForecast(start, tt.rainAt...)}
+			h := newTestHandler(provider, park, museum)
+
+			itinerary, err := h.Plan(context.Background(), PlanRequest{
+				Slots: []PlanSlot{{Name: "afternoon", From: tt.from, To: tt.from.Add(9 * time.Hour)}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stop := itinerary.Stops[0]
+			if stop.Name != tt.want {
+				t.Errorf("got %s, want %s", stop.Name, tt.want)
+			}
+			if itinerary.Fallback != tt.wantFallback {
+				t.Errorf("got fallback %q, want %q", itinerary.Fallback, tt.wantFallback)
+			}
+			if !strings.Contains(stop.Reason, tt.wantReason) {
+				t.Errorf("got reason %q, want it to mention %q", stop.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+// locklessClient is the weather cache with no fetch lock to be had, so
+// every fetch goes ahead on its own.
+type locklessClient struct {
+	*mgetClient
+}
+
+func (c locklessClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	return redis.NewBoolResult(false, errors.New("unreachable"))
+}
+
+func TestPlanUsesTheForecastsItHasWhenOthersFail(t *testing.T) {
+	park := Activities{ID: 1, Name: "Park", Postcode: "BT1 1AA", Sunny: true}
+	beach := Activities{ID: 2, Name: "Beach", Postcode: "BT2 2BB", Sunny: true}
+	museum := Activities{ID: 3, Name: "Museum", Postcode: "BT3 3CC"}
+	start := time.Now().Add(24 * time.Hour).Truncate(3 * time.Hour)
+
+	client := &mgetClient{values: make(map[string]string)}
+	cache := NewWeatherCache(locklessClient{client})
+	value, err := json.Marshal(hourlyForecast(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.values[cache.key("forecast", park.Postcode)] = string(value)
+	provider := NewFakeWeatherProvider()
+	provider.Err = gobreaker.ErrOpenState
+	h := newTestHandler(provider, park, beach, museum)
+	h.WeatherCache = cache
+
+	itinerary, err := h.Plan(context.Background(), PlanRequest{
+		Slots: []PlanSlot{{Name: "afternoon", From: start, To: start.Add(6 * time.Hour)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itinerary.Stops[0].Name; got != "Park" {
+		t.Errorf("got %s, want Park from its cached forecast", got)
+	}
+	if itinerary.Fallback != "" {
+		t.Errorf("got fallback %q, want none", itinerary.Fallback)
+	}
+	if provider.Calls != 1 {
+		t.Errorf("got %d weather calls, want only Beach's", provider.Calls)
+	}
+}
+
+func TestShortestRoute(t *testing.T) {
+	// along a line of longitude from the start at 0: greedily taking the
+	// nearest first, at 1, leaves a longer way round to -10
+	at := func(id int64, lon float64) planOption {
+		return planOption{activity: Activities{ID: id, Coordinates: &Coordinates{Lat: 54, Lon: lon}}}
+	}
+	start := &Coordinates{Lat: 54, Lon: 0}
+	outdoor := func(o planOption) planOption {
+		o.weather = &Weather{}
+		return o
+	}
+
+	tests := []struct {
+		name    string
+		choices []slotChoice
+		want    []int64
+	}{
+		{
+			name: "not the nearest first",
+			choices: []slotChoice{
+				{indoor: []planOption{at(1, 0.01), at(2, -0.02)}},
+				{indoor: []planOption{at(3, -0.1)}},
+			},
+			want: []int64{2, 3},
+		},
+		{
+			name: "no activity twice",
+			choices: []slotChoice{
+				{indoor: []planOption{at(1, 0.01), at(2, 0.5)}},
+				{indoor: []planOption{at(1, 0.01), at(2, 0.5)}},
+			},
+			want: []int64{1, 2},
+		},
+		{
+			name: "outdoors when any are left",
+			choices: []slotChoice{
+				{outdoor: []planOption{outdoor(at(1, 0.5))}, indoor: []planOption{at(2, 0.01)}},
+			},
+			want: []int64{1},
+		},
+		{
+			name: "indoors once the outdoor ones are planned",
+			choices: []slotChoice{
+				{outdoor: []planOption{outdoor(at(1, 0.01))}},
+				{outdoor: []planOption{outdoor(at(1, 0.01))}, indoor: []planOption{at(2, 0.02)}},
+			},
+			want: []int64{1, 2},
+		},
+		{
+			name: "fills as many slots as it can",
+			choices: []slotChoice{
+				{indoor: []planOption{at(1, 0.01), at(2, 0.9)}},
+				{indoor: []planOption{at(1, 0.01)}},
+				{},
+			},
+			want: []int64{2, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int64
+			for _, o := range shortestRoute(tt.choices, start) {
+				if o == nil {
+					got = append(got, 0)
+					continue
+				}
+				got = append(got, o.activity.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePlanRequestIgnoresRecommendationParameters(t *testing.T) {
+	h := newTestHandler(NewFakeWeatherProvider())
+	date := time.Now().In(h.timeZone()).AddDate(0, 0, 1).Format("2006-01-02")
+	request := httptest.NewRequest("GET", "/plan?lat=54.6&lon=-5.9&date="+date+"&at=soon&limit=0&strategy=nonsense", nil)
+
+	req, err := h.parsePlanRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Near == nil || len(req.Slots) != defaultPlanSlots {
+		t.Errorf("got %+v, want %d slots from 54.6, -5.9", req, defaultPlanSlots)
+	}
+}
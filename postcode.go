@@ -0,0 +1,28 @@
+package activities
+
+import (
+	"regexp"
+	"strings"
+)
+
+var ukPostcode = regexp.MustCompile(`^(GIR 0AA|[A-PR-UWYZ]([0-9]{1,2}|[A-HK-Y][0-9]{1,2}|[0-9][A-HJKPS-UW]|[A-HK-Y][0-9][ABEHMNPRV-Y]) [0-9][ABD-HJLNP-UW-Z]{2})$`)
+
+// NormalizePostcode upper-cases a postcode and puts a single space before
+// the inward code, so "bt71nn" and "BT7 1NN" are stored the same way.
+func NormalizePostcode(postcode string) string {
+	compact := compactPostcode(postcode)
+	if len(compact) < 5 {
+		return compact
+	}
+	return compact[:len(compact)-3] + " " + compact[len(compact)-3:]
+}
+
+// compactPostcode upper-cases a postcode, or the start of one, and takes
+// the spaces out.
+func compactPostcode(postcode string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+}
+
+func ValidPostcode(postcode string) bool {
+	return ukPostcode.MatchString(NormalizePostcode(postcode))
+}
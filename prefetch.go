@@ -0,0 +1,133 @@
+package activities
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultWeatherConcurrency = 4
+
+func (h *Handler) weatherConcurrency() int {
+	if h.WeatherConcurrency <= 0 {
+		return defaultWeatherConcurrency
+	}
+	return h.WeatherConcurrency
+}
+
+type weatherResult struct {
+	weather Weather
+	cached  bool
+	err     error
+}
+
+// cachedWeatherAt is weatherAt answered from the cache alone, for every
+// postcode in one round trip. What's found is keyed by normalized postcode.
+func (h *Handler) cachedWeatherAt(ctx context.Context, postcodes []string, at time.Time) map[string]Weather {
+	cache := h.weatherCache()
+	found := make(map[string]Weather)
+	if isNearNow(at) {
+		for postcode, entry := range cache.GetMany(ctx, postcodes) {
+			found[postcode] = entry.Weather
+		}
+		return found
+	}
+	for postcode, forecast := range cache.GetForecasts(ctx, postcodes) {
+		if item, err := forecast.Nearest(at); err == nil {
+			found[postcode] = forecast.AsWeather(item)
+		}
+	}
+	return found
+}
+
+// prefetchWeather looks up the weather at each distinct postcode among the
+// candidates, which should be in the order they'd be tried. Cached weather
+// is always used; at most limit postcodes are fetched from the provider, by
+// a pool of workers. Postcodes beyond the limit are missing from the result.
+func (h *Handler) prefetchWeather(ctx context.Context, candidates []Activities, at time.Time, limit int) map[string]weatherResult {
+	results := make(map[string]weatherResult)
+	distinct, postcodes := distinctPostcodes(candidates)
+	cached := h.cachedWeatherAt(ctx, postcodes, at)
+	var mu sync.Mutex
+	var toFetch []Activities
+	for _, a := range distinct {
+		key := NormalizePostcode(a.Postcode)
+		if w, ok := cached[key]; ok {
+			results[key] = weatherResult{weather: w, cached: true}
+		} else if len(toFetch) < limit {
+			toFetch = append(toFetch, a)
+		}
+	}
+
+	skipped := h.fetchEach(ctx, toFetch, func(a Activities) {
+		w, cached, err := h.weatherAt(ctx, h.locate(ctx, a), at)
+		mu.Lock()
+		results[NormalizePostcode(a.Postcode)] = weatherResult{weather: w, cached: cached, err: err}
+		mu.Unlock()
+	})
+	for _, a := range skipped {
+		results[NormalizePostcode(a.Postcode)] = weatherResult{err: ctx.Err()}
+	}
+	return results
+}
+
+// distinctPostcodes keeps the first of candidates at each postcode, in
+// order, and lists their postcodes.
+func distinctPostcodes(candidates []Activities) ([]Activities, []string) {
+	seen := make(map[string]bool)
+	var distinct []Activities
+	var postcodes []string
+	for _, a := range candidates {
+		key := NormalizePostcode(a.Postcode)
+		if !seen[key] {
+			seen[key] = true
+			distinct = append(distinct, a)
+			postcodes = append(postcodes, a.Postcode)
+		}
+	}
+	return distinct, postcodes
+}
+
+// fetchEach calls fetch for each of activityList on a pool of workers,
+// returning those it didn't get to because ctx was done first.
+func (h *Handler) fetchEach(ctx context.Context, activityList []Activities, fetch func(a Activities)) []Activities {
+	var skipped []Activities
+	jobs := make(chan Activities)
+	var wg sync.WaitGroup
+	for i := 0; i < h.weatherConcurrency() && i < len(activityList); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				fetch(a)
+			}
+		}()
+	}
+	for _, a := range activityList {
+		select {
+		case jobs <- a:
+		case <-ctx.Done():
+			skipped = append(skipped, a)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return skipped
+}
+
+// strategyOrder lists candidates in the order strategy would pick them,
+// without changing the slice it was given. Strategies that can't order
+// them in one go are asked to pick from what's left until nothing is.
+func strategyOrder(strategy SelectionStrategy, candidates []Activities) []Activities {
+	if o, ok := strategy.(candidateOrderer); ok {
+		return o.Order(candidates)
+	}
+	remaining := append([]Activities(nil), candidates...)
+	ordered := make([]Activities, 0, len(candidates))
+	for len(remaining) > 0 {
+		index := strategy.Pick(remaining)
+		ordered = append(ordered, remaining[index])
+		remaining = append(remaining[:index], remaining[index+1:]...)
+	}
+	return ordered
+}
@@ -0,0 +1,50 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// mgetClient is as much of Redis as reading the weather cache in bulk
+// needs.
+type mgetClient struct {
+	redis.Cmdable
+	values map[string]string
+	calls  int
+}
+
+func (c *mgetClient) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	c.calls++
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if v, ok := c.values[key]; ok {
+			values[i] = v
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func TestCachedWeatherAtReadsInOneRoundTrip(t *testing.T) {
+	client := &mgetClient{values: make(map[string]string)}
+	cache := NewWeatherCache(client)
+	for _, postcode := range []string{"BT1 1AA", "BT3 3CC"} {
+		value, err := json.Marshal(CachedWeather{Postcode: postcode, Weather: Weather{Weather: []WeatherCondition{{ID: 800, Main: "Clear"}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.values[cache.key("current", postcode)] = string(value)
+	}
+	h := &Handler{WeatherCache: cache}
+
+	found := h.cachedWeatherAt(context.Background(), []string{"bt1 1aa", "BT2 2BB", "BT3 3CC"}, time.Time{})
+	if client.calls != 1 {
+		t.Errorf("got %d round trips, want 1", client.calls)
+	}
+	if len(found) != 2 || found["BT1 1AA"].Weather[0].Main != "Clear" || found["BT3 3CC"].Weather[0].Main != "Clear" {
+		t.Errorf("got %v, want BT1 1AA and BT3 3CC", found)
+	}
+}
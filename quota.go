@@ -0,0 +1,262 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// the OpenWeatherMap free tier
+	defaultCallsPerMinute = 60
+	defaultDailyBudget    = 1000
+	defaultMaxQuotaWait   = 2 * time.Second
+	usageRetention        = 8 * 24 * time.Hour
+)
+
+const FallbackQuotaExhausted = "weather_quota_exhausted"
+
+var ErrQuotaExhausted = errors.New("weather API quota exhausted")
+
+// WeatherQuota rations calls to the weather provider across every replica.
+// A token bucket in Redis allows PerMinute calls a minute, and a counter per
+// provider per UTC day cuts calls off once DailyBudget have been made. Zero
+// turns either limit off. Calls are allowed when Redis can't be reached, or
+// Client is nil.
+type WeatherQuota struct {
+	Client      redis.Cmdable
+	Namespace   string
+	PerMinute   int
+	DailyBudget int
+	// MaxWait is how long a call may wait for a token before giving up.
+	MaxWait time.Duration
+}
+
+func NewWeatherQuota(client redis.Cmdable) *WeatherQuota {
+	return &WeatherQuota{
+		Client:      client,
+		Namespace:   "activities:quota",
+		PerMinute:   defaultCallsPerMinute,
+		DailyBudget: defaultDailyBudget,
+		MaxWait:     defaultMaxQuotaWait,
+	}
+}
+
+func (h *Handler) quota() *WeatherQuota {
+	if h.Quota == nil {
+		return NewWeatherQuota(h.redisClient())
+	}
+	return h.Quota
+}
+
+func (q *WeatherQuota) bucketKey(provider string) string {
+	return q.Namespace + ":bucket:" + provider
+}
+
+func (q *WeatherQuota) usageKey(day time.Time, provider string) string {
+	return q.Namespace + ":usage:" + day.UTC().Format("2006-01-02") + ":" + provider
+}
+
+// takeTokenScript refills the bucket for the time since it was last used
+// and takes a token if there is one, returning 1 and 0, or 0 and how many
+// milliseconds until there will be.
+var takeTokenScript = redis.NewScript(`local capacity = tonumber(ARGV[1])
+local per_ms = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local last = tonumber(redis.call("HGET", KEYS[1], "last"))
+if tokens == nil or last == nil then
+	tokens, last = capacity, now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - last) * per_ms)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens, allowed = tokens - 1, 1
+else
+	wait = math.ceil((1 - tokens) / per_ms)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], 120000)
+return {allowed, wait}`)
+
+// refundTokenScript puts a token back in the bucket, up to capacity.
+var refundTokenScript = redis.NewScript(`local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+if tokens ~= nil then
+	redis.call("HSET", KEYS[1], "tokens", tostring(math.min(tonumber(ARGV[1]), tokens + 1)))
+end
+return 1`)
+
+// Take reserves a call to provider, waiting up to MaxWait for the bucket to
+// refill. It fails with ErrQuotaExhausted when the daily budget is spent or
+// no token turns up in time. The call is counted before the budget is
+// checked, so replicas racing for the last call can't all have it.
+func (q *WeatherQuota) Take(ctx context.Context, provider string) error {
+	if q.Client == nil {
+		return nil
+	}
+	usageKey := q.usageKey(time.Now(), provider)
+	used, err := q.count(ctx, usageKey, 1)
+	counted := err == nil
+	if err != nil {
+		log.Println("could not count the weather API call", err)
+	} else if q.DailyBudget > 0 && used > int64(q.DailyBudget) {
+		q.uncount(ctx, usageKey)
+		return fmt.Errorf("%w: all %d %s calls for today have been made", ErrQuotaExhausted, q.DailyBudget, provider)
+	}
+
+	if err := q.takeToken(ctx, provider); err != nil {
+		if counted {
+			q.uncount(ctx, usageKey)
+		}
+		return err
+	}
+	return nil
+}
+
+// Refund gives back a call reserved with Take that was never made, such as
+// one the circuit breaker refused.
+func (q *WeatherQuota) Refund(ctx context.Context, provider string) {
+	if q.Client == nil {
+		return
+	}
+	q.uncount(ctx, q.usageKey(time.Now(), provider))
+	if q.PerMinute > 0 {
+		if err := refundTokenScript.Run(ctx, q.Client, []string{q.bucketKey(provider)}, q.PerMinute).Err(); err != nil {
+			log.Println("could not refund the weather API token", err)
+		}
+	}
+}
+
+// takeToken waits for a token from provider's bucket.
+func (q *WeatherQuota) takeToken(ctx context.Context, provider string) error {
+	if q.PerMinute <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(q.MaxWait)
+	for {
+		now := time.Now()
+		result, err := takeTokenScript.Run(ctx, q.Client, []string{q.bucketKey(provider)},
+			q.PerMinute, float64(q.PerMinute)/float64(time.Minute.Milliseconds()), now.UnixNano()/int64(time.Millisecond)).Int64Slice()
+		if err != nil {
+			log.Println("could not take a weather API token", err)
+			return nil
+		}
+		if result[0] == 1 {
+			return nil
+		}
+		wait := time.Duration(result[1]) * time.Millisecond
+		if now.Add(wait).After(deadline) {
+			return fmt.Errorf("%w: over %d %s calls a minute", ErrQuotaExhausted, q.PerMinute, provider)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// count adds n to the calls recorded at usageKey, returning the new total.
+func (q *WeatherQuota) count(ctx context.Context, usageKey string, n int64) (int64, error) {
+	var total *redis.IntCmd
+	_, err := q.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		total = pipe.IncrBy(ctx, usageKey, n)
+		pipe.Expire(ctx, usageKey, usageRetention)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total.Val(), nil
+}
+
+// uncount takes back a call counted at usageKey that wasn't made.
+func (q *WeatherQuota) uncount(ctx context.Context, usageKey string) {
+	if _, err := q.count(ctx, usageKey, -1); err != nil {
+		log.Println("could not uncount the weather API call", err)
+	}
+}
+
+type ProviderUsage struct {
+	Provider  string `json:"provider"`
+	Calls     int    `json:"calls"`
+	Budget    int    `json:"budget,omitempty"`
+	Remaining *int   `json:"remaining,omitempty"`
+}
+
+type QuotaUsage struct {
+	Date      string          `json:"date"`
+	PerMinute int             `json:"per_minute,omitempty"`
+	Providers []ProviderUsage `json:"providers"`
+}
+
+// Usage reports the calls made to each provider on the UTC day of day.
+func (q *WeatherQuota) Usage(ctx context.Context, day time.Time) (QuotaUsage, error) {
+	usage := QuotaUsage{Date: day.UTC().Format("2006-01-02"), PerMinute: q.PerMinute, Providers: []ProviderUsage{}}
+	if q.Client == nil {
+		return usage, nil
+	}
+	prefix := q.usageKey(day, "")
+	iter := q.Client.Scan(ctx, 0, escapeGlob(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		calls, err := q.Client.Get(ctx, iter.Val()).Int()
+		if err != nil {
+			continue
+		}
+		p := ProviderUsage{Provider: strings.TrimPrefix(iter.Val(), prefix), Calls: calls, Budget: q.DailyBudget}
+		if q.DailyBudget > 0 {
+			remaining := q.DailyBudget - calls
+			if remaining < 0 {
+				remaining = 0
+			}
+			p.Remaining = &remaining
+		}
+		usage.Providers = append(usage.Providers, p)
+	}
+	return usage, iter.Err()
+}
+
+// providerName identifies a provider in the usage counters.
+func providerName(p WeatherProvider) string {
+	switch p.(type) {
+	case *OpenWeatherMap:
+		return "openweathermap"
+	case *OpenMeteo:
+		return "open-meteo"
+	case *FakeWeatherProvider:
+		return "fake"
+	}
+	return strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", p), "*"))
+}
+
+// WeatherUsageEndpoint reports today's calls to the weather providers, or
+// another day's with ?date=YYYY-MM-DD.
+func (h *Handler) WeatherUsageEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			writer.Header().Set("Allow", "GET")
+			writeError(writer, ErrMethodNotAllowed)
+			return
+		}
+		day := time.Now()
+		if v := request.URL.Query().Get("date"); v != "" {
+			var err error
+			if day, err = time.Parse("2006-01-02", v); err != nil {
+				writeError(writer, &ValidationError{Fields: map[string]string{"date": "must be a date like 2006-01-02"}})
+				return
+			}
+		}
+		usage, err := h.quota().Usage(request.Context(), day)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, usage)
+	}
+}
@@ -0,0 +1,99 @@
+package activities
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	maxAlternatives = 20
+
+	weatherWeight  = 0.5
+	distanceWeight = 0.3
+	ratingWeight   = 0.2
+
+	// comfortableTemp is the temperature, in °C, that scores best
+	comfortableTemp = 20.0
+)
+
+// Score is how well an activity suits a request, from 0 to 1, and the
+// parts it was made from. Parts that don't apply, like distance when the
+// caller didn't say where they are, score 1.
+type Score struct {
+	Total    float64 `json:"total"`
+	Weather  float64 `json:"weather"`
+	Distance float64 `json:"distance"`
+	Rating   float64 `json:"rating"`
+}
+
+// conditionScore favours clear skies, then cloud, then haze, over anything
+// wetter that the rules still let through.
+func conditionScore(id int) float64 {
+	switch {
+	case id == 800:
+		return 1
+	case id == 801:
+		return 0.9
+	case id == 802:
+		return 0.8
+	case id >= 803 && id <= 804:
+		return 0.6
+	case id >= 700 && id < 800:
+		return 0.4
+	}
+	return 0.2
+}
+
+// weatherScore rates the weather, or returns 1 when there is none because
+// the activity doesn't depend on it.
+func weatherScore(w *Weather) float64 {
+	if w == nil || len(w.Weather) == 0 {
+		return 1
+	}
+	comfort := 1 - math.Min(math.Abs(w.Main.Temp-comfortableTemp)/comfortableTemp, 1)
+	return 0.7*conditionScore(w.Weather[0].ID) + 0.3*comfort
+}
+
+func distanceScore(req RecommendationRequest, distanceKm *float64) float64 {
+	if distanceKm == nil || req.RadiusKm <= 0 {
+		return 1
+	}
+	return math.Max(0, 1-*distanceKm/req.RadiusKm)
+}
+
+func roundScore(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func scoreOf(req RecommendationRequest, r Recommendation) Score {
+	s := Score{
+		Weather:  weatherScore(r.Conditions),
+		Distance: distanceScore(req, r.DistanceKm),
+		Rating:   r.Activity.Rating / 5,
+	}
+	s.Total = weatherWeight*s.Weather + distanceWeight*s.Distance + ratingWeight*s.Rating
+	return Score{Total: roundScore(s.Total), Weather: roundScore(s.Weather), Distance: roundScore(s.Distance), Rating: roundScore(s.Rating)}
+}
+
+// rank scores the suitable candidates in ev and returns the best req.Limit
+// of them, best first. Those the session was recently recommended come
+// after the rest whatever their score.
+func (h *Handler) rank(req RecommendationRequest, ev evaluation) []Recommendation {
+	ranked := make([]Recommendation, 0, len(ev.suitable))
+	for _, a := range ev.suitable {
+		r := h.newRecommendation(req, ev, a)
+		score := scoreOf(req, r)
+		r.Score = &score
+		ranked = append(ranked, r)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Repeat != ranked[j].Repeat {
+			return !ranked[i].Repeat
+		}
+		return ranked[i].Score.Total > ranked[j].Score.Total
+	})
+	if len(ranked) > req.Limit {
+		ranked = ranked[:req.Limit]
+	}
+	return ranked
+}
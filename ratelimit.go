@@ -0,0 +1,178 @@
+package activities
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimit allows Requests in any Window.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+var defaultRateLimit = RateLimit{Requests: 60, Window: time.Minute}
+
+// RateLimiter limits how often each client may call a route, counting
+// requests over a sliding window in Redis so every replica shares the
+// count. Clients are told apart by their X-API-Key header when it's one of
+// APIKeys, or failing that their IP address. Requests are let through when
+// Redis can't be reached, or Client is nil.
+type RateLimiter struct {
+	Client    redis.Cmdable
+	Namespace string
+	// Default applies to routes that aren't in Routes. A route whose limit
+	// allows no requests isn't limited.
+	Default RateLimit
+	Routes  map[string]RateLimit
+	// APIKeys are the keys that get a limit of their own. Any other key is
+	// ignored and the request limited by IP, so clients can't get round
+	// the limit by making keys up.
+	APIKeys map[string]bool
+	// TrustedProxies is how many proxies in front of the service add the
+	// address they were called from to X-Forwarded-For. The client's IP is
+	// the entry that many from the right, since anything further left was
+	// sent by the client. Zero ignores the header.
+	TrustedProxies int
+}
+
+func NewRateLimiter(client redis.Cmdable) *RateLimiter {
+	return &RateLimiter{
+		Client:    client,
+		Namespace: "activities:ratelimit",
+		Default:   defaultRateLimit,
+	}
+}
+
+func (h *Handler) rateLimiter() *RateLimiter {
+	if h.RateLimiter == nil {
+		return NewRateLimiter(h.redisClient())
+	}
+	return h.RateLimiter
+}
+
+func (l *RateLimiter) limit(route string) RateLimit {
+	if limit, ok := l.Routes[route]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+// client identifies who made the request. API keys are hashed so they
+// aren't kept in Redis.
+func (l *RateLimiter) client(request *http.Request) string {
+	if key := request.Header.Get("X-API-Key"); key != "" && l.APIKeys[key] {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	if l.TrustedProxies > 0 {
+		if forwarded := request.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			// fewer entries than proxies means the first is already theirs
+			i := len(hops) - l.TrustedProxies
+			if i < 0 {
+				i = 0
+			}
+			if ip := strings.TrimSpace(hops[i]); ip != "" {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// slidingWindowScript drops requests older than the window, then records
+// this one if there's room. It returns whether it was allowed, how many
+// more would be, and the milliseconds until the oldest one leaves the
+// window.
+var slidingWindowScript = redis.NewScript(`local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	count, allowed = count + 1, 1
+end
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+local reset = window
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}`)
+
+type rateLimitResult struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration
+}
+
+func (l *RateLimiter) allow(ctx context.Context, route, client string, limit RateLimit) (rateLimitResult, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return rateLimitResult{}, err
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	member := strconv.FormatInt(now, 10) + "-" + hex.EncodeToString(id)
+	key := l.Namespace + ":" + route + ":" + client
+	values, err := slidingWindowScript.Run(ctx, l.Client, []string{key}, now, limit.Window.Milliseconds(), limit.Requests, member).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	return rateLimitResult{
+		allowed:   values[0] == 1,
+		remaining: int(values[1]),
+		reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// RateLimit wraps an endpoint so each client may only call it as often as
+// the limit for route allows, answering 429 Too Many Requests otherwise.
+func (h *Handler) RateLimit(route string, next func(writer http.ResponseWriter, request *http.Request)) func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		limiter := h.rateLimiter()
+		limit := limiter.limit(route)
+		if limiter.Client == nil || limit.Requests <= 0 || limit.Window <= 0 {
+			next(writer, request)
+			return
+		}
+		result, err := limiter.allow(request.Context(), route, limiter.client(request), limit)
+		if err != nil {
+			log.Println("could not check the rate limit", err)
+			next(writer, request)
+			return
+		}
+
+		resetSeconds := strconv.Itoa(int(math.Ceil(result.reset.Seconds())))
+		writer.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+		writer.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+		writer.Header().Set("X-RateLimit-Reset", resetSeconds)
+		if !result.allowed {
+			writer.Header().Set("Retry-After", resetSeconds)
+			writeError(writer, fmt.Errorf("%w: at most %d every %s", ErrRateLimited, limit.Requests, limit.Window))
+			return
+		}
+		next(writer, request)
+	}
+}
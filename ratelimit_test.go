@@ -0,0 +1,56 @@
+package activities
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiterClient(t *testing.T) {
+	tests := []struct {
+		name           string
+		key            string
+		forwardedFor   []string
+		trustedProxies int
+		wantPrefix     string
+	}{
+		{name: "no key", wantPrefix: "ip:192.0.2.1"},
+		{name: "known key", key: "known", wantPrefix: "key:"},
+		{name: "made up key", key: "made-up", wantPrefix: "ip:192.0.2.1"},
+		{name: "forwarded for, not trusted", forwardedFor: []string{"203.0.113.7"}, wantPrefix: "ip:192.0.2.1"},
+		{name: "forwarded by one proxy", forwardedFor: []string{"203.0.113.7"}, trustedProxies: 1, wantPrefix: "ip:203.0.113.7"},
+		{
+			name:           "spoofed by the client",
+			forwardedFor:   []string{"198.51.100.99, 203.0.113.7"},
+			trustedProxies: 1,
+			wantPrefix:     "ip:203.0.113.7",
+		},
+		{
+			name:           "spoofed behind two proxies",
+			forwardedFor:   []string{"198.51.100.99", "203.0.113.7, 10.0.0.2"},
+			trustedProxies: 2,
+			wantPrefix:     "ip:203.0.113.7",
+		},
+		{
+			name:           "fewer entries than proxies",
+			forwardedFor:   []string{"203.0.113.7"},
+			trustedProxies: 2,
+			wantPrefix:     "ip:203.0.113.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &RateLimiter{APIKeys: map[string]bool{"known": true}, TrustedProxies: tt.trustedProxies}
+			request := httptest.NewRequest("GET", "/sunny", nil)
+			if tt.key != "" {
+				request.Header.Set("X-API-Key", tt.key)
+			}
+			for _, v := range tt.forwardedFor {
+				request.Header.Add("X-Forwarded-For", v)
+			}
+			if got := limiter.client(request); !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Errorf("got %q, want it to start %q", got, tt.wantPrefix)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ActivityRepository stores the activities catalogue.
+type ActivityRepository interface {
+	ListBySunny(ctx context.Context, sunny bool) ([]Activities, error)
+	Candidates(ctx context.Context, filter CandidateFilter) ([]Activities, error)
+	List(ctx context.Context, filter ActivityFilter) (ActivityPage, error)
+	Get(ctx context.Context, id int64) (Activities, error)
+	Create(ctx context.Context, a Activities) (Activities, error)
+	Update(ctx context.Context, a Activities) error
+	Delete(ctx context.Context, id int64) error
+	// Locations lists each distinct postcode in the catalogue once.
+	Locations(ctx context.Context) ([]Location, error)
+	Tags(ctx context.Context) ([]Tag, error)
+	CreateTag(ctx context.Context, name string) (Tag, error)
+	DeleteTag(ctx context.Context, name string) error
+	// SetTags replaces the tags of an activity, creating any that don't
+	// exist yet.
+	SetTags(ctx context.Context, id int64, tags []string) error
+}
+
+func (h *Handler) repository() ActivityRepository {
+	if h.Repository == nil {
+		return &PostgresActivityRepository{Pool: h.Db}
+	}
+	return h.Repository
+}
+
+type PostgresActivityRepository struct {
+	Pool *pgxpool.Pool
+}
+
+// activityColumns ends with the activity's tag names, in order, so it can
+// only be selected from the activities table unaliased.
+const activityColumns = `id, name, postcode, sunny, category, latitude, longitude, rating, opening_hours,
+	needs_daylight, min_daylight_minutes, ARRAY(SELECT t.name FROM activity_tags at JOIN tags t ON t.id = at.tag_id
+		WHERE at.activity_id = activities.id ORDER BY t.name)`
+
+func scanActivity(row pgx.Row, a *Activities) error {
+	var lat, lon *float64
+	if err := row.Scan(&a.ID, &a.Name, &a.Postcode, &a.Sunny, &a.Category, &lat, &lon, &a.Rating, &a.OpeningHours, &a.NeedsDaylight, &a.MinDaylightMinutes, &a.Tags); err != nil {
+		return err
+	}
+	if lat != nil && lon != nil {
+		a.Coordinates = &Coordinates{Lat: *lat, Lon: *lon}
+	}
+	return nil
+}
+
+// coordinateArgs splits optional coordinates into nullable column values.
+func coordinateArgs(c *Coordinates) (lat, lon *float64) {
+	if c == nil {
+		return nil, nil
+	}
+	return &c.Lat, &c.Lon
+}
+
+func scanActivities(rows pgx.Rows) ([]Activities, error) {
+	defer rows.Close()
+	var activityList []Activities
+	for rows.Next() {
+		var a Activities
+		if err := scanActivity(rows, &a); err != nil {
+			return nil, &DatabaseError{Op: "scanning activities", Err: err}
+		}
+		activityList = append(activityList, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DatabaseError{Op: "reading activities", Err: err}
+	}
+	return activityList, nil
+}
+
+func (r *PostgresActivityRepository) ListBySunny(ctx context.Context, sunny bool) ([]Activities, error) {
+	rows, err := r.Pool.Query(ctx, "SELECT "+activityColumns+" FROM activities WHERE sunny = $1", sunny)
+	if err != nil {
+		return nil, &DatabaseError{Op: "querying activities", Err: err}
+	}
+	return scanActivities(rows)
+}
+
+// CandidateFilter selects the activities a recommendation can choose from.
+// When Near is set only activities within RadiusKm of it are returned.
+// Candidates must have every tag in Include and none in Exclude.
+type CandidateFilter struct {
+	Sunny    bool
+	Near     *Coordinates
+	RadiusKm float64
+	Include  []string
+	Exclude  []string
+}
+
+func (r *PostgresActivityRepository) Candidates(ctx context.Context, filter CandidateFilter) ([]Activities, error) {
+	args := []interface{}{filter.Sunny}
+	where := []string{"sunny = $1"}
+	if filter.Near != nil {
+		box := NewBoundingBox(*filter.Near, filter.RadiusKm)
+		args = append(args, box.MinLat, box.MaxLat, box.MinLon, box.MaxLon)
+		where = append(where, fmt.Sprintf("latitude BETWEEN $%d AND $%d AND longitude BETWEEN $%d AND $%d", len(args)-3, len(args)-2, len(args)-1, len(args)))
+	}
+	if len(filter.Include) > 0 {
+		args = append(args, filter.Include)
+		where = append(where, fmt.Sprintf(`id IN (SELECT at.activity_id FROM activity_tags at JOIN tags t ON t.id = at.tag_id
+			WHERE t.name = ANY($%[1]d) GROUP BY at.activity_id HAVING count(*) = cardinality($%[1]d::text[]))`, len(args)))
+	}
+	if len(filter.Exclude) > 0 {
+		args = append(args, filter.Exclude)
+		where = append(where, fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM activity_tags at JOIN tags t ON t.id = at.tag_id
+			WHERE at.activity_id = activities.id AND t.name = ANY($%d))`, len(args)))
+	}
+
+	rows, err := r.Pool.Query(ctx, "SELECT "+activityColumns+" FROM activities WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return nil, &DatabaseError{Op: "querying candidate activities", Err: err}
+	}
+	activityList, err := scanActivities(rows)
+	if err != nil || filter.Near == nil {
+		return activityList, err
+	}
+	return withinRadius(activityList, *filter.Near, filter.RadiusKm), nil
+}
+
+func (r *PostgresActivityRepository) List(ctx context.Context, filter ActivityFilter) (ActivityPage, error) {
+	var where []string
+	var args []interface{}
+	if filter.Sunny != nil {
+		args = append(args, *filter.Sunny)
+		where = append(where, fmt.Sprintf("sunny = $%d", len(args)))
+	}
+	if filter.Postcode != "" {
+		args = append(args, escapeLike(compactPostcode(filter.Postcode))+"%")
+		where = append(where, fmt.Sprintf(`replace(postcode, ' ', '') LIKE $%d ESCAPE '\'`, len(args)))
+	}
+	conditions := ""
+	if len(where) > 0 {
+		conditions = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	page := ActivityPage{Limit: filter.Limit, Offset: filter.Offset}
+	err := r.Pool.QueryRow(ctx, "SELECT count(*) FROM activities"+conditions, args...).Scan(&page.Total)
+	if err != nil {
+		return ActivityPage{}, &DatabaseError{Op: "counting activities", Err: err}
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf("SELECT %s FROM activities%s ORDER BY id LIMIT $%d OFFSET $%d", activityColumns, conditions, len(args)-1, len(args))
+	rows, err := r.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return ActivityPage{}, &DatabaseError{Op: "listing activities", Err: err}
+	}
+	if page.Activities, err = scanActivities(rows); err != nil {
+		return ActivityPage{}, err
+	}
+	if page.Activities == nil {
+		page.Activities = []Activities{}
+	}
+	return page, nil
+}
+
+func (r *PostgresActivityRepository) Get(ctx context.Context, id int64) (Activities, error) {
+	var a Activities
+	err := scanActivity(r.Pool.QueryRow(ctx, "SELECT "+activityColumns+" FROM activities WHERE id = $1", id), &a)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Activities{}, ErrActivityNotFound
+	}
+	if err != nil {
+		return Activities{}, &DatabaseError{Op: "fetching activity", Err: err}
+	}
+	return a, nil
+}
+
+// Create adds a to the catalogue along with its tags.
+func (r *PostgresActivityRepository) Create(ctx context.Context, a Activities) (Activities, error) {
+	lat, lon := coordinateArgs(a.Coordinates)
+	err := r.Pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `INSERT INTO activities (name, postcode, sunny, category, latitude, longitude, rating, opening_hours, needs_daylight, min_daylight_minutes)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+			a.Name, a.Postcode, a.Sunny, a.Category, lat, lon, a.Rating, a.OpeningHours, a.NeedsDaylight, a.MinDaylightMinutes).Scan(&a.ID)
+		if err != nil || len(a.Tags) == 0 {
+			return err
+		}
+		return setActivityTags(ctx, tx, a.ID, a.Tags)
+	})
+	if err != nil {
+		return Activities{}, &DatabaseError{Op: "creating activity", Err: err}
+	}
+	return a, nil
+}
+
+// Update replaces a, and its tags unless they're nil.
+func (r *PostgresActivityRepository) Update(ctx context.Context, a Activities) error {
+	lat, lon := coordinateArgs(a.Coordinates)
+	err := r.Pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `UPDATE activities SET name = $2, postcode = $3, sunny = $4, category = $5, latitude = $6, longitude = $7, rating = $8,
+			opening_hours = $9, needs_daylight = $10, min_daylight_minutes = $11 WHERE id = $1`,
+			a.ID, a.Name, a.Postcode, a.Sunny, a.Category, lat, lon, a.Rating, a.OpeningHours, a.NeedsDaylight, a.MinDaylightMinutes)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrActivityNotFound
+		}
+		if a.Tags == nil {
+			return nil
+		}
+		return setActivityTags(ctx, tx, a.ID, a.Tags)
+	})
+	if errors.Is(err, ErrActivityNotFound) {
+		return err
+	}
+	if err != nil {
+		return &DatabaseError{Op: "updating activity", Err: err}
+	}
+	return nil
+}
+
+func (r *PostgresActivityRepository) Delete(ctx context.Context, id int64) error {
+	tag, err := r.Pool.Exec(ctx, "DELETE FROM activities WHERE id = $1", id)
+	if err != nil {
+		return &DatabaseError{Op: "deleting activity", Err: err}
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrActivityNotFound
+	}
+	return nil
+}
+
+func (r *PostgresActivityRepository) Locations(ctx context.Context) ([]Location, error) {
+	rows, err := r.Pool.Query(ctx, `SELECT DISTINCT ON (postcode) postcode, latitude, longitude FROM activities
+		ORDER BY postcode, latitude IS NULL`)
+	if err != nil {
+		return nil, &DatabaseError{Op: "querying activity locations", Err: err}
+	}
+	defer rows.Close()
+	var locations []Location
+	for rows.Next() {
+		var loc Location
+		var lat, lon *float64
+		if err := rows.Scan(&loc.Postcode, &lat, &lon); err != nil {
+			return nil, &DatabaseError{Op: "scanning activity locations", Err: err}
+		}
+		if lat != nil && lon != nil {
+			loc.Coordinates = &Coordinates{Lat: *lat, Lon: *lon}
+		}
+		locations = append(locations, loc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DatabaseError{Op: "reading activity locations", Err: err}
+	}
+	return locations, nil
+}
+
+func (r *PostgresActivityRepository) Tags(ctx context.Context) ([]Tag, error) {
+	rows, err := r.Pool.Query(ctx, `SELECT t.name, count(at.activity_id) FROM tags t
+		LEFT JOIN activity_tags at ON at.tag_id = t.id GROUP BY t.name ORDER BY t.name`)
+	if err != nil {
+		return nil, &DatabaseError{Op: "querying tags", Err: err}
+	}
+	defer rows.Close()
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Name, &t.Activities); err != nil {
+			return nil, &DatabaseError{Op: "scanning tags", Err: err}
+		}
+		tags = append(tags, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DatabaseError{Op: "reading tags", Err: err}
+	}
+	return tags, nil
+}
+
+func (r *PostgresActivityRepository) CreateTag(ctx context.Context, name string) (Tag, error) {
+	t := Tag{Name: name}
+	err := r.Pool.QueryRow(ctx, `WITH created AS (INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING)
+		SELECT count(*) FROM activity_tags at JOIN tags t ON t.id = at.tag_id WHERE t.name = $1`, name).Scan(&t.Activities)
+	if err != nil {
+		return Tag{}, &DatabaseError{Op: "creating tag", Err: err}
+	}
+	return t, nil
+}
+
+func (r *PostgresActivityRepository) DeleteTag(ctx context.Context, name string) error {
+	tag, err := r.Pool.Exec(ctx, "DELETE FROM tags WHERE name = $1", name)
+	if err != nil {
+		return &DatabaseError{Op: "deleting tag", Err: err}
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+func (r *PostgresActivityRepository) SetTags(ctx context.Context, id int64, tags []string) error {
+	err := r.Pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id FROM activities WHERE id = $1 FOR UPDATE", id).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrActivityNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return setActivityTags(ctx, tx, id, tags)
+	})
+	if errors.Is(err, ErrActivityNotFound) {
+		return err
+	}
+	if err != nil {
+		return &DatabaseError{Op: "setting tags", Err: err}
+	}
+	return nil
+}
+
+func setActivityTags(ctx context.Context, tx pgx.Tx, id int64, tags []string) error {
+	if _, err := tx.Exec(ctx, "INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", tags); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM activity_tags WHERE activity_id = $1", id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO activity_tags (activity_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)", id, tags)
+	return err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,176 @@
+package activities
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ActivityResponse struct {
+	Name       string             `json:"name"`
+	Postcode   string             `json:"postcode"`
+	Sunny      bool               `json:"sunny"`
+	Weather    string             `json:"weather,omitempty"`
+	WeatherAt  *time.Time         `json:"weather_at,omitempty"`
+	Cached     bool               `json:"cached"`
+	Discarded  int                `json:"discarded"`
+	Rejected   []RejectedActivity `json:"rejected,omitempty"`
+	Fallback   string             `json:"fallback,omitempty"`
+	DistanceKm *float64           `json:"distance_km,omitempty"`
+	Repeat     bool               `json:"repeat,omitempty"`
+	ClosesAt   *time.Time         `json:"closes_at,omitempty"`
+	Sunset     *time.Time         `json:"sunset,omitempty"`
+	Conditions *WeatherSummary    `json:"conditions,omitempty"`
+	Score      *Score             `json:"score,omitempty"`
+}
+
+// WeatherSummary is the part of the weather an activity was judged on.
+type WeatherSummary struct {
+	Condition   string  `json:"condition"`
+	Description string  `json:"description,omitempty"`
+	Temp        float64 `json:"temp"`
+	FeelsLike   float64 `json:"feels_like"`
+	WindSpeed   float64 `json:"wind_speed"`
+	Clouds      int     `json:"clouds"`
+}
+
+func newWeatherSummary(w *Weather) *WeatherSummary {
+	if w == nil || len(w.Weather) == 0 {
+		return nil
+	}
+	return &WeatherSummary{
+		Condition:   w.Weather[0].Main,
+		Description: w.Weather[0].Description,
+		Temp:        w.Main.Temp,
+		FeelsLike:   w.Main.FeelsLike,
+		WindSpeed:   w.Wind.Speed,
+		Clouds:      w.Clouds.All,
+	}
+}
+
+// RankedResponse lists alternatives best first, for requests with a limit.
+type RankedResponse struct {
+	Activities []ActivityResponse `json:"activities"`
+	Discarded  int                `json:"discarded"`
+	Rejected   []RejectedActivity `json:"rejected,omitempty"`
+	Fallback   string             `json:"fallback,omitempty"`
+}
+
+type RejectedActivity struct {
+	Name     string     `json:"name"`
+	Postcode string     `json:"postcode"`
+	Reason   string     `json:"reason"`
+	NextOpen *time.Time `json:"next_open,omitempty"`
+}
+
+func newActivityResponse(r Recommendation) ActivityResponse {
+	resp := ActivityResponse{
+		Name:       r.Activity.Name,
+		Postcode:   r.Activity.Postcode,
+		Sunny:      r.Activity.Sunny,
+		Weather:    r.Weather,
+		Cached:     r.Cached,
+		Discarded:  len(r.Discarded),
+		Fallback:   r.Fallback,
+		DistanceKm: r.DistanceKm,
+		Repeat:     r.Repeat,
+		ClosesAt:   r.ClosesAt,
+		Sunset:     r.Sunset,
+	}
+	for _, d := range r.Discarded {
+		resp.Rejected = append(resp.Rejected, RejectedActivity{Name: d.Activity.Name, Postcode: d.Activity.Postcode, Reason: d.Reason, NextOpen: d.NextOpen})
+	}
+	if !r.WeatherAt.IsZero() {
+		resp.WeatherAt = &r.WeatherAt
+	}
+	return resp
+}
+
+// newRankedResponse lists r.Ranked with the weather and score of each.
+func newRankedResponse(r Recommendation) RankedResponse {
+	top := newActivityResponse(r)
+	resp := RankedResponse{Activities: []ActivityResponse{}, Discarded: top.Discarded, Rejected: top.Rejected, Fallback: r.Fallback}
+	for _, alt := range r.Ranked {
+		item := newActivityResponse(alt)
+		item.Discarded, item.Rejected, item.Fallback = 0, nil, ""
+		item.Score = alt.Score
+		item.Conditions = newWeatherSummary(alt.Conditions)
+		resp.Activities = append(resp.Activities, item)
+	}
+	return resp
+}
+
+// writeRecommendation writes r as JSON, or as the original "Name Postcode"
+// string for clients that prefer text/plain. Ranked alternatives are
+// written as a list, or one per line.
+func writeRecommendation(writer http.ResponseWriter, request *http.Request, r Recommendation) {
+	if r.Fallback != "" {
+		writer.Header().Set("X-Activity-Fallback", r.Fallback)
+	}
+	writer.Header().Add("Vary", "Accept")
+	if negotiate(request.Header.Get("Accept"), "application/json", "text/plain") == "text/plain" {
+		lines := []string{fmt.Sprintf("%s %s", r.Activity.Name, r.Activity.Postcode)}
+		if len(r.Ranked) > 0 {
+			lines = lines[:0]
+			for _, alt := range r.Ranked {
+				lines = append(lines, fmt.Sprintf("%s %s", alt.Activity.Name, alt.Activity.Postcode))
+			}
+		}
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write([]byte(strings.Join(lines, "\n")))
+		if err != nil {
+			log.Println("could not write the bytes", err)
+		}
+		return
+	}
+	if len(r.Ranked) > 0 {
+		writeJSON(writer, http.StatusOK, newRankedResponse(r))
+		return
+	}
+	writeJSON(writer, http.StatusOK, newActivityResponse(r))
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		log.Println("could not write the json response", err)
+	}
+}
+
+// negotiate picks the offer the Accept header ranks highest, falling back to
+// the first offer when the header is empty or matches nothing.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ := offers[0], -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			if q > bestQ && q > 0 && mediaMatches(mediaType, offer) {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+func mediaMatches(pattern, offer string) bool {
+	if pattern == "*/*" || pattern == offer {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(pattern, "*"))
+}
@@ -0,0 +1,163 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ConditionRange is an inclusive range of OpenWeatherMap condition ids, e.g.
+// 500-531 for every kind of rain.
+type ConditionRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+func (c ConditionRange) contains(id int) bool {
+	return id >= c.From && id <= c.To
+}
+
+// WeatherRule describes the weather an activity can be done in. Thresholds
+// left nil aren't checked. Temperatures are in Celsius, speeds in m/s and
+// visibility in metres.
+type WeatherRule struct {
+	AllowedConditions []ConditionRange `json:"allowed_conditions,omitempty"`
+	BlockedConditions []ConditionRange `json:"blocked_conditions,omitempty"`
+	MinTemp           *float64         `json:"min_temp,omitempty"`
+	MaxTemp           *float64         `json:"max_temp,omitempty"`
+	MinFeelsLike      *float64         `json:"min_feels_like,omitempty"`
+	MaxFeelsLike      *float64         `json:"max_feels_like,omitempty"`
+	MaxWindSpeed      *float64         `json:"max_wind_speed,omitempty"`
+	MaxGust           *float64         `json:"max_gust,omitempty"`
+	MinVisibility     *int             `json:"min_visibility,omitempty"`
+}
+
+// DefaultWeatherRule rules out thunderstorms, drizzle, rain, snow and
+// tornadoes, which is what the sunny endpoint has always avoided.
+var DefaultWeatherRule = WeatherRule{
+	BlockedConditions: []ConditionRange{{From: 200, To: 699}, {From: 781, To: 781}},
+}
+
+// Evaluate reports whether w suits the rule, and if not, why.
+func (r WeatherRule) Evaluate(w Weather) (bool, string) {
+	for _, condition := range w.Weather {
+		for _, blocked := range r.BlockedConditions {
+			if blocked.contains(condition.ID) {
+				return false, fmt.Sprintf("condition %s (%d) is not suitable", condition.Description, condition.ID)
+			}
+		}
+		if len(r.AllowedConditions) > 0 && !anyContains(r.AllowedConditions, condition.ID) {
+			return false, fmt.Sprintf("condition %s (%d) is not allowed", condition.Description, condition.ID)
+		}
+	}
+	switch {
+	case r.MinTemp != nil && w.Main.Temp < *r.MinTemp:
+		return false, fmt.Sprintf("temperature %.1f is below %.1f", w.Main.Temp, *r.MinTemp)
+	case r.MaxTemp != nil && w.Main.Temp > *r.MaxTemp:
+		return false, fmt.Sprintf("temperature %.1f is above %.1f", w.Main.Temp, *r.MaxTemp)
+	case r.MinFeelsLike != nil && w.Main.FeelsLike < *r.MinFeelsLike:
+		return false, fmt.Sprintf("feels like %.1f which is below %.1f", w.Main.FeelsLike, *r.MinFeelsLike)
+	case r.MaxFeelsLike != nil && w.Main.FeelsLike > *r.MaxFeelsLike:
+		return false, fmt.Sprintf("feels like %.1f which is above %.1f", w.Main.FeelsLike, *r.MaxFeelsLike)
+	case r.MaxWindSpeed != nil && w.Wind.Speed > *r.MaxWindSpeed:
+		return false, fmt.Sprintf("wind speed %.1f is above %.1f", w.Wind.Speed, *r.MaxWindSpeed)
+	case r.MaxGust != nil && w.Wind.Gust > *r.MaxGust:
+		return false, fmt.Sprintf("gusts of %.1f are above %.1f", w.Wind.Gust, *r.MaxGust)
+	case r.MinVisibility != nil && w.Visibility < *r.MinVisibility:
+		return false, fmt.Sprintf("visibility %d is below %d", w.Visibility, *r.MinVisibility)
+	}
+	return true, ""
+}
+
+func anyContains(ranges []ConditionRange, id int) bool {
+	for _, r := range ranges {
+		if r.contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSet picks the rule for an activity: its own rule if it has one, then
+// its category's, then the default.
+type RuleSet struct {
+	Default    WeatherRule            `json:"default"`
+	Categories map[string]WeatherRule `json:"categories,omitempty"`
+	Activities map[int64]WeatherRule  `json:"activities,omitempty"`
+}
+
+func (rs *RuleSet) For(a Activities) WeatherRule {
+	if rule, ok := rs.Activities[a.ID]; ok {
+		return rule
+	}
+	if rule, ok := rs.Categories[a.Category]; ok && a.Category != "" {
+		return rule
+	}
+	return rs.Default
+}
+
+func (h *Handler) rules() *RuleSet {
+	if h.Rules == nil {
+		return &RuleSet{Default: DefaultWeatherRule}
+	}
+	return h.Rules
+}
+
+// LoadRuleSetFile reads a RuleSet from a JSON file. A file without a default
+// rule gets DefaultWeatherRule.
+func LoadRuleSetFile(path string) (*RuleSet, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		RuleSet
+		Default *WeatherRule `json:"default"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("parsing rules in %s: %w", path, err)
+	}
+	rs := raw.RuleSet
+	rs.Default = DefaultWeatherRule
+	if raw.Default != nil {
+		rs.Default = *raw.Default
+	}
+	return &rs, nil
+}
+
+// LoadRuleSetPostgres reads the weather_rules table.
+func LoadRuleSetPostgres(ctx context.Context, pool *pgxpool.Pool) (*RuleSet, error) {
+	rs := &RuleSet{
+		Default:    DefaultWeatherRule,
+		Categories: make(map[string]WeatherRule),
+		Activities: make(map[int64]WeatherRule),
+	}
+	rows, err := pool.Query(ctx, "SELECT activity_id, category, rule FROM weather_rules")
+	if err != nil {
+		return nil, &DatabaseError{Op: "querying weather rules", Err: err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var activityID *int64
+		var category *string
+		var rule WeatherRule
+		if err := rows.Scan(&activityID, &category, &rule); err != nil {
+			return nil, &DatabaseError{Op: "scanning weather rules", Err: err}
+		}
+		switch {
+		case activityID != nil:
+			rs.Activities[*activityID] = rule
+		case category != nil:
+			rs.Categories[*category] = rule
+		default:
+			rs.Default = rule
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &DatabaseError{Op: "reading weather rules", Err: err}
+	}
+	return rs, nil
+}
@@ -0,0 +1,274 @@
+package activities
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SelectionStrategy decides which candidate to try next. Pick is given a
+// non-empty list and returns an index into it; Recommended is told which
+// activity was finally returned to the caller.
+type SelectionStrategy interface {
+	Pick(candidates []Activities) int
+	Recommended(a Activities)
+}
+
+// candidateOrderer is implemented by strategies that can list candidates
+// in the order they'd pick them, most likely first, more cheaply than by
+// calling Pick over and over. Order leaves the slice it's given alone.
+type candidateOrderer interface {
+	Order(candidates []Activities) []Activities
+}
+
+const (
+	StrategyRandom      = "random"
+	StrategyWeighted    = "weighted"
+	StrategyRoundRobin  = "round-robin"
+	StrategyLeastRecent = "least-recent"
+)
+
+// NewStrategies returns one of each built-in strategy keyed by name, with
+// the random ones seeded from seed.
+func NewStrategies(seed int64) map[string]SelectionStrategy {
+	return map[string]SelectionStrategy{
+		StrategyRandom:      NewRandomStrategy(seed),
+		StrategyWeighted:    NewWeightedStrategy(seed+1, RatingWeight),
+		StrategyRoundRobin:  &RoundRobinStrategy{},
+		StrategyLeastRecent: NewLeastRecentStrategy(seed + 2),
+	}
+}
+
+func (h *Handler) strategies() map[string]SelectionStrategy {
+	h.strategiesOnce.Do(func() {
+		if h.Strategies == nil {
+			h.Strategies = NewStrategies(time.Now().UnixNano())
+		}
+	})
+	return h.Strategies
+}
+
+// strategy returns the named strategy, or the default when name is empty.
+func (h *Handler) strategy(name string) (SelectionStrategy, error) {
+	if name == "" {
+		if h.Strategy != nil {
+			return h.Strategy, nil
+		}
+		name = StrategyRandom
+	}
+	s, ok := h.strategies()[name]
+	if !ok {
+		return nil, &ValidationError{Fields: map[string]string{"strategy": fmt.Sprintf("unknown strategy %q", name)}}
+	}
+	return s, nil
+}
+
+// lockedRand is a *rand.Rand that's safe to share between requests.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+// shuffled returns a copy of candidates in random order.
+func (l *lockedRand) shuffled(candidates []Activities) []Activities {
+	l.mu.Lock()
+	perm := l.r.Perm(len(candidates))
+	l.mu.Unlock()
+	shuffled := make([]Activities, len(candidates))
+	for i, j := range perm {
+		shuffled[i] = candidates[j]
+	}
+	return shuffled
+}
+
+// RandomStrategy picks uniformly at random.
+type RandomStrategy struct {
+	rand *lockedRand
+}
+
+func NewRandomStrategy(seed int64) *RandomStrategy {
+	return &RandomStrategy{rand: &lockedRand{r: rand.New(rand.NewSource(seed))}}
+}
+
+func (s *RandomStrategy) Pick(candidates []Activities) int {
+	return s.rand.Intn(len(candidates))
+}
+
+func (s *RandomStrategy) Order(candidates []Activities) []Activities {
+	return s.rand.shuffled(candidates)
+}
+
+func (s *RandomStrategy) Recommended(a Activities) {}
+
+// WeightedStrategy picks at random in proportion to Weight.
+type WeightedStrategy struct {
+	rand   *lockedRand
+	Weight func(a Activities) float64
+}
+
+// RatingWeight favours higher rated activities without ruling out unrated
+// ones.
+func RatingWeight(a Activities) float64 {
+	return 1 + a.Rating
+}
+
+func NewWeightedStrategy(seed int64, weight func(a Activities) float64) *WeightedStrategy {
+	return &WeightedStrategy{rand: &lockedRand{r: rand.New(rand.NewSource(seed))}, Weight: weight}
+}
+
+func (s *WeightedStrategy) Pick(candidates []Activities) int {
+	var total float64
+	weights := make([]float64, len(candidates))
+	for i, a := range candidates {
+		if w := s.Weight(a); w > 0 {
+			weights[i] = w
+			total += w
+		}
+	}
+	if total == 0 {
+		return s.rand.Intn(len(candidates))
+	}
+	target := s.rand.Float64() * total
+	for i, w := range weights {
+		if target < w {
+			return i
+		}
+		target -= w
+	}
+	return len(candidates) - 1
+}
+
+// Order draws the candidates one after another without replacement, each
+// in proportion to its weight, by giving each a random key that's smaller
+// the heavier it is. Those without weight come last, in random order.
+func (s *WeightedStrategy) Order(candidates []Activities) []Activities {
+	ordered := s.rand.shuffled(candidates)
+	keys := make([]float64, len(ordered))
+	for i, a := range ordered {
+		keys[i] = math.Inf(1)
+		if w := s.Weight(a); w > 0 {
+			keys[i] = -math.Log(1-s.rand.Float64()) / w
+		}
+	}
+	order := make([]int, len(ordered))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+	result := make([]Activities, len(ordered))
+	for i, j := range order {
+		result[i] = ordered[j]
+	}
+	return result
+}
+
+func (s *WeightedStrategy) Recommended(a Activities) {}
+
+// RoundRobinStrategy works through the catalogue in id order, carrying on
+// after the last activity it recommended.
+type RoundRobinStrategy struct {
+	mu     sync.Mutex
+	lastID int64
+}
+
+func (s *RoundRobinStrategy) Pick(candidates []Activities) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, lowest := -1, 0
+	for i, a := range candidates {
+		if a.ID < candidates[lowest].ID {
+			lowest = i
+		}
+		if a.ID > s.lastID && (next < 0 || a.ID < candidates[next].ID) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return lowest
+	}
+	return next
+}
+
+// Order lists the candidates by id, starting after the last recommended.
+func (s *RoundRobinStrategy) Order(candidates []Activities) []Activities {
+	s.mu.Lock()
+	lastID := s.lastID
+	s.mu.Unlock()
+	ordered := append([]Activities(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+	next := sort.Search(len(ordered), func(i int) bool { return ordered[i].ID > lastID })
+	return append(ordered[next:], ordered[:next]...)
+}
+
+func (s *RoundRobinStrategy) Recommended(a Activities) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID = a.ID
+}
+
+// LeastRecentStrategy picks the activity that was recommended longest ago,
+// or never, breaking ties at random. It remembers recommendations made by
+// this process only.
+type LeastRecentStrategy struct {
+	mu   sync.Mutex
+	rand *lockedRand
+	last map[int64]time.Time
+}
+
+func NewLeastRecentStrategy(seed int64) *LeastRecentStrategy {
+	return &LeastRecentStrategy{
+		rand: &lockedRand{r: rand.New(rand.NewSource(seed))},
+		last: make(map[int64]time.Time),
+	}
+}
+
+func (s *LeastRecentStrategy) Pick(candidates []Activities) int {
+	s.mu.Lock()
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.last[candidates[order[i]].ID].Before(s.last[candidates[order[j]].ID])
+	})
+	oldest := s.last[candidates[order[0]].ID]
+	ties := 1
+	for ties < len(order) && s.last[candidates[order[ties]].ID].Equal(oldest) {
+		ties++
+	}
+	s.mu.Unlock()
+	return order[s.rand.Intn(ties)]
+}
+
+// Order lists the candidates oldest recommendation first, breaking ties at
+// random.
+func (s *LeastRecentStrategy) Order(candidates []Activities) []Activities {
+	ordered := s.rand.shuffled(candidates)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return s.last[ordered[i].ID].Before(s.last[ordered[j].ID])
+	})
+	return ordered
+}
+
+func (s *LeastRecentStrategy) Recommended(a Activities) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[a.ID] = time.Now()
+}
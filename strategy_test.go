@@ -0,0 +1,160 @@
+package activities
+
+import (
+	"reflect"
+	"testing"
+)
+
+func strategyCandidates() []Activities {
+	return []Activities{
+		{ID: 1, Name: "Park", Rating: 0},
+		{ID: 2, Name: "Beach", Rating: 5},
+		{ID: 3, Name: "Zoo", Rating: 2},
+		{ID: 4, Name: "Lake", Rating: 4},
+	}
+}
+
+// picks has s pick n times from candidates, telling it each was
+// recommended, and returns the ids picked.
+func picks(s SelectionStrategy, candidates []Activities, n int) []int64 {
+	var ids []int64
+	for i := 0; i < n; i++ {
+		a := candidates[s.Pick(candidates)]
+		s.Recommended(a)
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func TestStrategiesAreDeterministicForASeed(t *testing.T) {
+	for _, name := range []string{StrategyRandom, StrategyWeighted, StrategyRoundRobin, StrategyLeastRecent} {
+		t.Run(name, func(t *testing.T) {
+			first := picks(NewStrategies(42)[name], strategyCandidates(), 20)
+			second := picks(NewStrategies(42)[name], strategyCandidates(), 20)
+			if !reflect.DeepEqual(first, second) {
+				t.Errorf("the same seed picked %v then %v", first, second)
+			}
+		})
+	}
+}
+
+func TestWeightedStrategyFavoursRating(t *testing.T) {
+	counts := make(map[int64]int)
+	for _, id := range picks(NewWeightedStrategy(1, RatingWeight), strategyCandidates(), 1000) {
+		counts[id]++
+	}
+	// weights are 1, 6, 3 and 5
+	if !(counts[2] > counts[4] && counts[4] > counts[3] && counts[3] > counts[1]) {
+		t.Errorf("picks %v aren't in proportion to rating", counts)
+	}
+	if counts[1] == 0 {
+		t.Error("an unrated activity was never picked")
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	tests := []struct {
+		name   string
+		lastID int64
+		want   []int64
+	}{
+		{name: "from the start", want: []int64{1, 2, 3, 4, 1, 2}},
+		{name: "carries on after the last", lastID: 2, want: []int64{3, 4, 1}},
+		{name: "wraps past the highest id", lastID: 9, want: []int64{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &RoundRobinStrategy{lastID: tt.lastID}
+			// the order candidates arrive in doesn't matter
+			candidates := strategyCandidates()
+			candidates[0], candidates[3] = candidates[3], candidates[0]
+			if got := picks(s, candidates, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastRecentStrategy(t *testing.T) {
+	s := NewLeastRecentStrategy(7)
+	candidates := strategyCandidates()
+	first := picks(s, candidates, len(candidates))
+	seen := make(map[int64]bool)
+	for _, id := range first {
+		if seen[id] {
+			t.Fatalf("picked %d again before trying everything: %v", id, first)
+		}
+		seen[id] = true
+	}
+	// after that it goes round in the same order, oldest first
+	if again := picks(s, candidates, len(candidates)); !reflect.DeepEqual(again, first) {
+		t.Errorf("got %v after %v, want the same order", again, first)
+	}
+}
+
+// pickOrder is how strategyOrder lists candidates for strategies that
+// can't order them.
+func pickOrder(s SelectionStrategy, candidates []Activities) []int64 {
+	var ids []int64
+	for _, a := range strategyOrder(struct{ SelectionStrategy }{s}, candidates) {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func TestStrategyOrder(t *testing.T) {
+	for name, s := range NewStrategies(3) {
+		t.Run(name, func(t *testing.T) {
+			candidates := strategyCandidates()
+			before := append([]Activities(nil), candidates...)
+			ordered := strategyOrder(s, candidates)
+			seen := make(map[int64]bool)
+			for _, a := range ordered {
+				seen[a.ID] = true
+			}
+			if len(ordered) != len(candidates) || len(seen) != len(candidates) {
+				t.Errorf("got %v, want each candidate once", ordered)
+			}
+			if !reflect.DeepEqual(candidates, before) {
+				t.Errorf("the candidates were changed to %v", candidates)
+			}
+		})
+	}
+
+	t.Run("round robin orders as it picks", func(t *testing.T) {
+		s := &RoundRobinStrategy{lastID: 2}
+		var got []int64
+		for _, a := range strategyOrder(s, strategyCandidates()) {
+			got = append(got, a.ID)
+		}
+		if want := pickOrder(s, strategyCandidates()); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("least recent puts the oldest first", func(t *testing.T) {
+		s := NewLeastRecentStrategy(5)
+		candidates := strategyCandidates()
+		for _, i := range []int{2, 0, 3} {
+			s.Recommended(candidates[i])
+		}
+		var got []int64
+		for _, a := range s.Order(candidates) {
+			got = append(got, a.ID)
+		}
+		if want := []int64{2, 3, 1, 4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("weighted favours rating", func(t *testing.T) {
+		s := NewWeightedStrategy(9, RatingWeight)
+		first := make(map[int64]int)
+		for i := 0; i < 1000; i++ {
+			first[s.Order(strategyCandidates())[0].ID]++
+		}
+		if !(first[2] > first[4] && first[4] > first[3] && first[3] > first[1]) {
+			t.Errorf("firsts %v aren't in proportion to rating", first)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package activities
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxTags = 20
+
+// tagPattern is what a tag looks like once normalized: lower case words
+// joined by hyphens, such as "kid-friendly".
+var tagPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Tag is a label activities can be filtered by, and how many activities
+// have it.
+type Tag struct {
+	Name       string `json:"name"`
+	Activities int    `json:"activities"`
+}
+
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// normalizeTags normalizes, sorts and removes duplicates from tags, adding
+// a problem to verr under field for any that aren't valid.
+func normalizeTags(tags []string, field string, verr *ValidationError) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if !tagPattern.MatchString(tag) || len(tag) > maxNameLength {
+			verr.add(field, fmt.Sprintf("%q is not a valid tag", tag))
+			continue
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		verr.add(field, fmt.Sprintf("at most %d tags are allowed", maxTags))
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// queryTags reads a list of tags that may be given comma separated, by
+// repeating the parameter, or both.
+func queryTags(query url.Values, name string, verr *ValidationError) []string {
+	var tags []string
+	for _, v := range query[name] {
+		for _, tag := range strings.Split(v, ",") {
+			if strings.TrimSpace(tag) != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return normalizeTags(tags, name, verr)
+}
+
+// hasTags reports whether a has every tag in include and none in exclude.
+func hasTags(a Activities, include, exclude []string) bool {
+	tags := make(map[string]bool, len(a.Tags))
+	for _, tag := range a.Tags {
+		tags[tag] = true
+	}
+	for _, tag := range include {
+		if !tags[tag] {
+			return false
+		}
+	}
+	for _, tag := range exclude {
+		if tags[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// TagsEndpoint serves /tags: GET lists every tag with how many activities
+// have it, POST adds one.
+func (h *Handler) TagsEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			tags, err := h.repository().Tags(request.Context())
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, tags)
+		case http.MethodPost:
+			var in struct {
+				Name string `json:"name"`
+			}
+			decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&in); err != nil {
+				writeError(writer, fmt.Errorf("%w: %v", ErrInvalidInput, err))
+				return
+			}
+			var verr ValidationError
+			names := normalizeTags([]string{in.Name}, "name", &verr)
+			if err := verr.errOrNil(); err != nil {
+				writeError(writer, err)
+				return
+			}
+			tag, err := h.repository().CreateTag(request.Context(), names[0])
+			if err != nil {
+				writeError(writer, err)
+				return
+			}
+			writer.Header().Set("Location", strings.TrimSuffix(request.URL.Path, "/")+"/"+url.PathEscape(tag.Name))
+			writeJSON(writer, http.StatusCreated, tag)
+		default:
+			writer.Header().Set("Allow", "GET, POST")
+			writeError(writer, ErrMethodNotAllowed)
+		}
+	}
+}
+
+// TagEndpoint serves /tags/{name}: DELETE removes the tag from the
+// catalogue and every activity that has it.
+func (h *Handler) TagEndpoint() func(writer http.ResponseWriter, request *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodDelete {
+			writer.Header().Set("Allow", "DELETE")
+			writeError(writer, ErrMethodNotAllowed)
+			return
+		}
+		if err := h.repository().DeleteTag(request.Context(), normalizeTag(path.Base(request.URL.Path))); err != nil {
+			writeError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// activityTags serves /activities/{id}/tags: GET lists an activity's tags
+// and PUT replaces them with the list in the body.
+func (h *Handler) activityTags(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(path.Base(path.Dir(request.URL.Path)), 10, 64)
+	if err != nil {
+		writeError(writer, ErrActivityNotFound)
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		a, err := h.repository().Get(request.Context(), id)
+		if err != nil {
+			writeError(writer, err)
+			return
+		}
+		if a.Tags == nil {
+			a.Tags = []string{}
+		}
+		writeJSON(writer, http.StatusOK, a.Tags)
+	case http.MethodPut:
+		var tags []string
+		decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20))
+		if err := decoder.Decode(&tags); err != nil {
+			writeError(writer, fmt.Errorf("%w: %v", ErrInvalidInput, err))
+			return
+		}
+		var verr ValidationError
+		tags = normalizeTags(tags, "tags", &verr)
+		if err := verr.errOrNil(); err != nil {
+			writeError(writer, err)
+			return
+		}
+		if err := h.repository().SetTags(request.Context(), id, tags); err != nil {
+			writeError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, tags)
+	default:
+		writer.Header().Set("Allow", "GET, PUT")
+		writeError(writer, ErrMethodNotAllowed)
+	}
+}
@@ -0,0 +1,154 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultWarmSpacing = time.Second
+
+var ErrWarmerRunning = errors.New("the cache warmer is already running")
+
+// CacheWarmer keeps the current weather for every postcode in the catalogue
+// cached, refreshing entries before they expire so that requests rarely
+// wait on the provider. Replicas share the work through a Redis lock: only
+// the one holding it refreshes, and the others skip that run.
+type CacheWarmer struct {
+	Handler *Handler
+	// Interval is how often the catalogue is checked; entries that would
+	// expire before the next check are refreshed. Zero means half the
+	// cache TTL.
+	Interval time.Duration
+	// Spacing is the least time between calls to the provider, to stay
+	// within its quota. Zero means a second.
+	Spacing time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (h *Handler) NewCacheWarmer() *CacheWarmer {
+	return &CacheWarmer{Handler: h}
+}
+
+func (w *CacheWarmer) interval() time.Duration {
+	if w.Interval > 0 {
+		return w.Interval
+	}
+	if ttl := w.Handler.weatherCache().TTL; ttl > 0 {
+		return ttl / 2
+	}
+	return defaultWeatherTTL / 2
+}
+
+func (w *CacheWarmer) spacing() time.Duration {
+	if w.Spacing <= 0 {
+		return defaultWarmSpacing
+	}
+	return w.Spacing
+}
+
+// Start warms the cache straight away and then every Interval, in the
+// background, until Stop is called or ctx is done.
+func (w *CacheWarmer) Start(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		return ErrWarmerRunning
+	}
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.done = make(chan struct{})
+	go w.run(ctx, w.done)
+	return nil
+}
+
+// Stop stops the warmer and waits for a refresh in progress to give up.
+func (w *CacheWarmer) Stop() {
+	w.mu.Lock()
+	cancel, done := w.cancel, w.done
+	w.cancel, w.done = nil, nil
+	w.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (w *CacheWarmer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+	for {
+		refreshed, err := w.Warm(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("could not warm the weather cache", err)
+		}
+		if refreshed > 0 {
+			log.Printf("refreshed the weather for %d postcodes", refreshed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Warm refreshes the cached weather for each catalogue postcode that is
+// missing or would expire before the next run, returning how many were
+// refreshed. It does nothing when another replica holds the lock.
+func (w *CacheWarmer) Warm(ctx context.Context) (int, error) {
+	h := w.Handler
+	cache := h.weatherCache()
+	if cache.Client == nil {
+		return 0, nil
+	}
+	lock, ok, err := acquireLock(ctx, cache.Client, cache.Namespace+":lock:warmer", w.interval())
+	if err != nil || !ok {
+		return 0, err
+	}
+	defer func() {
+		if err := lock.Release(context.Background()); err != nil {
+			log.Println("could not release the cache warmer lock", err)
+		}
+	}()
+
+	locations, err := h.repository().Locations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	refreshed := 0
+	var last time.Time
+	for _, loc := range locations {
+		if !cache.Expiring(ctx, loc.Postcode, w.interval()) {
+			continue
+		}
+		if wait := w.spacing() - time.Since(last); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return refreshed, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		// a run can outlast the lock's TTL, so it's extended as we go
+		held, err := lock.Refresh(ctx)
+		if err != nil || !held {
+			return refreshed, err
+		}
+		last = time.Now()
+		if _, _, err := h.refreshWeather(ctx, h.resolve(ctx, loc)); err != nil {
+			if weatherFallback(err) != "" || ctx.Err() != nil {
+				return refreshed, err
+			}
+			log.Printf("could not refresh the weather for %s: %v", loc, err)
+			continue
+		}
+		refreshed++
+	}
+	return refreshed, nil
+}
@@ -0,0 +1,305 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WeatherProvider looks up the current weather for a location. Every
+// implementation returns the OpenWeatherMap shaped Weather struct so the
+// selection logic doesn't need to know which backend answered.
+type WeatherProvider interface {
+	GetWeather(ctx context.Context, loc Location) (Weather, error)
+}
+
+func (h *Handler) weatherProvider() WeatherProvider {
+	if h.WeatherProvider == nil {
+		return NewOpenWeatherMap(os.Getenv("WEATHER_API_KEY"))
+	}
+	return h.WeatherProvider
+}
+
+type OpenWeatherMap struct {
+	APIKey  string
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewOpenWeatherMap(apiKey string) *OpenWeatherMap {
+	return &OpenWeatherMap{
+		APIKey:  apiKey,
+		BaseURL: "http://api.openweathermap.org/data/2.5",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// query builds the location part of a request, preferring coordinates since
+// q= is a city name search that often can't make sense of a postcode.
+func (o *OpenWeatherMap) query(loc Location) url.Values {
+	query := url.Values{}
+	query.Set("appid", o.APIKey)
+	if loc.Coordinates != nil {
+		query.Set("lat", strconv.FormatFloat(loc.Coordinates.Lat, 'f', -1, 64))
+		query.Set("lon", strconv.FormatFloat(loc.Coordinates.Lon, 'f', -1, 64))
+	} else {
+		query.Set("q", loc.Postcode)
+	}
+	query.Set("units", "metric")
+	return query
+}
+
+func (o *OpenWeatherMap) GetWeather(ctx context.Context, loc Location) (Weather, error) {
+	var weather Weather
+
+	if err := getJSON(ctx, o.Client, o.BaseURL+"/weather?"+o.query(loc).Encode(), &weather); err != nil {
+		return Weather{}, fmt.Errorf("retrieving the weather for %s: %w", loc, err)
+	}
+	if len(weather.Weather) == 0 {
+		return Weather{}, fmt.Errorf("no weather conditions returned for %s", loc)
+	}
+	return weather, nil
+}
+
+// OpenMeteo uses the free Open-Meteo geocoding and forecast APIs, which need
+// no API key. The response is translated into the OpenWeatherMap format.
+type OpenMeteo struct {
+	GeocodingURL string
+	ForecastURL  string
+	Client       *http.Client
+}
+
+func NewOpenMeteo() *OpenMeteo {
+	return &OpenMeteo{
+		GeocodingURL: "https://geocoding-api.open-meteo.com/v1/search",
+		ForecastURL:  "https://api.open-meteo.com/v1/forecast",
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type openMeteoGeocoding struct {
+	Results []openMeteoPlace `json:"results"`
+}
+
+type openMeteoForecast struct {
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	UtcOffsetSeconds int     `json:"utc_offset_seconds"`
+	CurrentWeather   struct {
+		Temperature   float64 `json:"temperature"`
+		Windspeed     float64 `json:"windspeed"`
+		Winddirection float64 `json:"winddirection"`
+		Weathercode   int     `json:"weathercode"`
+		Time          int     `json:"time"`
+	} `json:"current_weather"`
+	Daily struct {
+		Sunrise []int `json:"sunrise"`
+		Sunset  []int `json:"sunset"`
+	} `json:"daily"`
+}
+
+type openMeteoPlace struct {
+	Name        string  `json:"name"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	CountryCode string  `json:"country_code"`
+}
+
+// geocode uses the location's coordinates when it has them and searches for
+// the postcode otherwise.
+func (o *OpenMeteo) geocode(ctx context.Context, loc Location) (openMeteoPlace, error) {
+	if loc.Coordinates != nil {
+		return openMeteoPlace{Name: loc.Postcode, Latitude: loc.Coordinates.Lat, Longitude: loc.Coordinates.Lon}, nil
+	}
+	var geo openMeteoGeocoding
+	query := url.Values{}
+	query.Set("name", loc.Postcode)
+	query.Set("count", "1")
+	if err := getJSON(ctx, o.Client, o.GeocodingURL+"?"+query.Encode(), &geo); err != nil {
+		return openMeteoPlace{}, fmt.Errorf("geocoding %s: %w", loc.Postcode, err)
+	}
+	if len(geo.Results) == 0 {
+		return openMeteoPlace{}, fmt.Errorf("could not geocode %s", loc.Postcode)
+	}
+	return geo.Results[0], nil
+}
+
+func (o *OpenMeteo) GetWeather(ctx context.Context, loc Location) (Weather, error) {
+	place, err := o.geocode(ctx, loc)
+	if err != nil {
+		return Weather{}, err
+	}
+
+	var forecast openMeteoForecast
+	query := url.Values{}
+	query.Set("latitude", fmt.Sprint(place.Latitude))
+	query.Set("longitude", fmt.Sprint(place.Longitude))
+	query.Set("current_weather", "true")
+	query.Set("daily", "sunrise,sunset")
+	query.Set("forecast_days", "1")
+	query.Set("windspeed_unit", "ms")
+	query.Set("timeformat", "unixtime")
+	query.Set("timezone", "auto")
+	if err := getJSON(ctx, o.Client, o.ForecastURL+"?"+query.Encode(), &forecast); err != nil {
+		return Weather{}, fmt.Errorf("retrieving the weather for %s: %w", loc, err)
+	}
+
+	var weather Weather
+	weather.Coord.Lat = forecast.Latitude
+	weather.Coord.Lon = forecast.Longitude
+	weather.Weather = []WeatherCondition{wmoCondition(forecast.CurrentWeather.Weathercode)}
+	weather.Main.Temp = forecast.CurrentWeather.Temperature
+	weather.Main.FeelsLike = forecast.CurrentWeather.Temperature
+	weather.Wind.Speed = forecast.CurrentWeather.Windspeed
+	weather.Wind.Deg = int(forecast.CurrentWeather.Winddirection)
+	weather.Dt = forecast.CurrentWeather.Time
+	weather.Sys.Country = place.CountryCode
+	if len(forecast.Daily.Sunrise) > 0 && len(forecast.Daily.Sunset) > 0 {
+		weather.Sys.Sunrise = forecast.Daily.Sunrise[0]
+		weather.Sys.Sunset = forecast.Daily.Sunset[0]
+	}
+	weather.Timezone = forecast.UtcOffsetSeconds
+	weather.Name = place.Name
+	weather.Cod = http.StatusOK
+	return weather, nil
+}
+
+// wmoCondition maps a WMO weather interpretation code onto the nearest
+// OpenWeatherMap condition id and group.
+func wmoCondition(code int) WeatherCondition {
+	switch code {
+	case 0:
+		return WeatherCondition{ID: 800, Main: "Clear", Description: "clear sky"}
+	case 1:
+		return WeatherCondition{ID: 801, Main: "Clouds", Description: "few clouds"}
+	case 2:
+		return WeatherCondition{ID: 802, Main: "Clouds", Description: "scattered clouds"}
+	case 3:
+		return WeatherCondition{ID: 804, Main: "Clouds", Description: "overcast clouds"}
+	case 45, 48:
+		return WeatherCondition{ID: 741, Main: "Fog", Description: "fog"}
+	case 51:
+		return WeatherCondition{ID: 300, Main: "Drizzle", Description: "light intensity drizzle"}
+	case 53:
+		return WeatherCondition{ID: 301, Main: "Drizzle", Description: "drizzle"}
+	case 55, 56, 57:
+		return WeatherCondition{ID: 302, Main: "Drizzle", Description: "heavy intensity drizzle"}
+	case 61:
+		return WeatherCondition{ID: 500, Main: "Rain", Description: "light rain"}
+	case 63:
+		return WeatherCondition{ID: 501, Main: "Rain", Description: "moderate rain"}
+	case 65:
+		return WeatherCondition{ID: 502, Main: "Rain", Description: "heavy intensity rain"}
+	case 66, 67:
+		return WeatherCondition{ID: 511, Main: "Rain", Description: "freezing rain"}
+	case 71, 77:
+		return WeatherCondition{ID: 600, Main: "Snow", Description: "light snow"}
+	case 73:
+		return WeatherCondition{ID: 601, Main: "Snow", Description: "snow"}
+	case 75:
+		return WeatherCondition{ID: 602, Main: "Snow", Description: "heavy snow"}
+	case 80:
+		return WeatherCondition{ID: 520, Main: "Rain", Description: "light intensity shower rain"}
+	case 81:
+		return WeatherCondition{ID: 521, Main: "Rain", Description: "shower rain"}
+	case 82:
+		return WeatherCondition{ID: 522, Main: "Rain", Description: "heavy intensity shower rain"}
+	case 85:
+		return WeatherCondition{ID: 620, Main: "Snow", Description: "light shower snow"}
+	case 86:
+		return WeatherCondition{ID: 621, Main: "Snow", Description: "shower snow"}
+	case 95:
+		return WeatherCondition{ID: 211, Main: "Thunderstorm", Description: "thunderstorm"}
+	case 96, 99:
+		return WeatherCondition{ID: 202, Main: "Thunderstorm", Description: "thunderstorm with heavy rain"}
+	}
+	return WeatherCondition{ID: 800, Main: "Clear", Description: "clear sky"}
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("error unmarshalling response to json: %w", err)
+	}
+	return nil
+}
+
+// FakeWeatherProvider serves canned weather from memory, for tests and local
+// development without an API key.
+type FakeWeatherProvider struct {
+	mu        sync.Mutex
+	Weather   map[string]Weather
+	Forecasts map[string]Forecast
+	Default   *Weather
+	Err       error
+	Calls     int
+}
+
+func NewFakeWeatherProvider() *FakeWeatherProvider {
+	return &FakeWeatherProvider{Weather: make(map[string]Weather)}
+}
+
+// representativeConditions gives a typical condition id for each
+// OpenWeatherMap condition group.
+var representativeConditions = map[string]int{
+	"Thunderstorm": 200,
+	"Drizzle":      300,
+	"Rain":         500,
+	"Snow":         600,
+	"Mist":         701,
+	"Fog":          741,
+	"Clear":        800,
+	"Clouds":       803,
+}
+
+// SetCondition stores a minimal Weather for postcode with the given main
+// condition, e.g. "Rain" or "Clear".
+func (f *FakeWeatherProvider) SetCondition(postcode, main string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Weather == nil {
+		f.Weather = make(map[string]Weather)
+	}
+	f.Weather[postcode] = Weather{Weather: []WeatherCondition{{ID: representativeConditions[main], Main: main}}}
+}
+
+func (f *FakeWeatherProvider) GetWeather(ctx context.Context, loc Location) (Weather, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls++
+	if f.Err != nil {
+		return Weather{}, f.Err
+	}
+	w, ok := f.Weather[loc.Postcode]
+	if !ok {
+		if f.Default == nil {
+			return Weather{}, fmt.Errorf("no weather configured for %s", loc.Postcode)
+		}
+		w = *f.Default
+	}
+	if loc.Coordinates != nil && w.Coord.Lat == 0 && w.Coord.Lon == 0 {
+		w.Coord.Lat = loc.Coordinates.Lat
+		w.Coord.Lon = loc.Coordinates.Lon
+	}
+	return w, nil
+}